@@ -1,5 +1,7 @@
 package geanstalkd
 
+import "io"
+
 // A JobRegistry stores and queries jobs. Must be thread-safe.
 type JobRegistry interface {
 	// Insert stores a new job in the registry. If a job with the same job
@@ -58,6 +60,25 @@ type JobPriorityQueue interface {
 	RemoveByID(JobID) error
 }
 
+// A JobQueue is a first-in-first-out queue of jobs. Must be thread-safe.
+type JobQueue interface {
+	// Push puts a new Job at the back of the queue. Returns
+	// `ErrJobAlreadyExist` if job already exists.
+	Push(*Job) error
+
+	// Pop removes and returns the Job at the front of the queue. Returns
+	// `ErrEmptyQueue` if there are no jobs in the queue.
+	Pop() (*Job, error)
+
+	// Peek returns the Job at the front of the queue. Returns `ErrEmptyQueue`
+	// if there are no jobs in the queue.
+	Peek() (*Job, error)
+
+	// RemoveByID removes a Job from the queue with a specific ID. Returns
+	// `ErrJobMissing` if the job was not in the queue.
+	RemoveByID(JobID) error
+}
+
 // TubePriorityQueue is a queue which orders `JobPriorityQueue`s according to a
 // specific priority. The queue MAY be backed by a heap, but could equally be
 // backed by a B-tree/LSM on disk. Must be thread-safe.
@@ -81,3 +102,15 @@ type TubePriorityQueue interface {
 	// Returns ErrQueueMissing if the tube couldn't be found.
 	RemoveByTube(Tube) error
 }
+
+// A BodyStore keeps job bodies out of memory. Must be thread-safe.
+type BodyStore interface {
+	// Put stores a body and returns a reference to it.
+	Put(body []byte) (BodyRef, error)
+
+	// Open returns a reader of a stored body. The reader must be closed.
+	Open(BodyRef) (io.ReadCloser, error)
+
+	// Delete frees a stored body. The body must not be opened afterwards.
+	Delete(BodyRef) error
+}
@@ -0,0 +1,223 @@
+package binlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// ErrUnsupportedVersion is returned when a beanstalkd binlog file has a
+// format version which can't be read.
+var ErrUnsupportedVersion = errors.New("unsupported beanstalkd binlog version")
+
+// beanstalkdVersion is the binlog format version written by beanstalkd since
+// version 1.10. It is the latest one.
+const beanstalkdVersion = 7
+
+// beanstalkdMaxTubeNameLen is the size of beanstalkd's tube name buffer,
+// including the terminating null byte.
+const beanstalkdMaxTubeNameLen = 201
+
+// The job states of beanstalkd.
+const (
+	beanstalkdInvalid  = 0
+	beanstalkdReady    = 1
+	beanstalkdReserved = 2
+	beanstalkdBuried   = 3
+	beanstalkdDelayed  = 4
+)
+
+// beanstalkdJobrec is beanstalkd's struct Jobrec, as laid out in memory by a
+// 64-bit C compiler. All times and durations are in nanoseconds.
+type beanstalkdJobrec struct {
+	ID         uint64
+	Pri        uint32
+	_          uint32
+	Delay      int64
+	TTR        int64
+	BodySize   int32
+	_          uint32
+	CreatedAt  int64
+	DeadlineAt int64
+	ReserveCt  uint32
+	TimeoutCt  uint32
+	ReleaseCt  uint32
+	BuryCt     uint32
+	KickCt     uint32
+	State      uint8
+	_          [3]byte
+}
+
+// ReadBeanstalkd reads the jobs in the binlog directory of a beanstalkd
+// server, which must have been written in version 7 of the format on a
+// little-endian machine. The jobs are returned in the order they were last
+// changed, so that buried jobs keep their order. Reserved jobs are returned
+// as ready, and jobs whose delay has passed are still returned as delayed.
+func ReadBeanstalkd(dir string) ([]*geanstalkd.Job, error) {
+	indexes, err := segmentIndexes(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &beanstalkdReader{
+		jobs:        make(map[geanstalkd.JobID]*geanstalkd.Job),
+		lastChanged: make(map[geanstalkd.JobID]int),
+	}
+	for _, index := range indexes {
+		path := filepath.Join(dir, segmentName(index))
+		if err := r.readFile(path); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+
+	jobs := make([]*geanstalkd.Job, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return r.lastChanged[jobs[i].ID] < r.lastChanged[jobs[j].ID] })
+	return jobs, nil
+}
+
+type beanstalkdReader struct {
+	jobs        map[geanstalkd.JobID]*geanstalkd.Job
+	lastChanged map[geanstalkd.JobID]int
+	seq         int
+}
+
+func (r *beanstalkdReader) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	var version int32
+	if err := binary.Read(br, binary.LittleEndian, &version); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if version != beanstalkdVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	for {
+		done, err := r.readRecord(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// beanstalkd crashed while writing the record.
+			return nil
+		} else if done || err != nil {
+			return err
+		}
+	}
+}
+
+// readRecord reads a record like beanstalkd's readrec does. Returns true when
+// the rest of the file is the zeroes it was preallocated with.
+func (r *beanstalkdReader) readRecord(br io.Reader) (bool, error) {
+	var nameLen int32
+	if err := binary.Read(br, binary.LittleEndian, &nameLen); err != nil {
+		return false, err
+	}
+	if nameLen < 0 || nameLen >= beanstalkdMaxTubeNameLen {
+		return false, fmt.Errorf("bad tube name length %d", nameLen)
+	}
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(br, name); err != nil {
+		return false, unexpectedEOF(err)
+	}
+
+	var rec beanstalkdJobrec
+	if err := binary.Read(br, binary.LittleEndian, &rec); err != nil {
+		return false, unexpectedEOF(err)
+	}
+	if rec.ID == 0 {
+		return true, nil
+	}
+
+	id := geanstalkd.JobID(rec.ID)
+	j, ok := r.jobs[id]
+	if !ok && nameLen == 0 {
+		// The full record was in a file which beanstalkd has deleted, so the
+		// job has been deleted or migrated to a later file.
+		return false, nil
+	}
+
+	switch rec.State {
+	case beanstalkdReady, beanstalkdReserved, beanstalkdBuried, beanstalkdDelayed:
+		var body []byte
+		if nameLen > 0 {
+			if rec.BodySize < 0 {
+				return false, fmt.Errorf("job %d has bad body size %d", id, rec.BodySize)
+			}
+			body = make([]byte, rec.BodySize)
+			if _, err := io.ReadFull(br, body); err != nil {
+				return false, unexpectedEOF(err)
+			}
+			// beanstalkd includes the line ending after the body.
+			body = bytes.TrimSuffix(body, []byte("\r\n"))
+		}
+
+		if !ok {
+			j = &geanstalkd.Job{ID: id, Tube: geanstalkd.Tube(name)}
+			r.jobs[id] = j
+		}
+		convertJobrec(&rec, j)
+		if body != nil {
+			j.Body = body
+		}
+		r.lastChanged[id] = r.seq
+		r.seq++
+	case beanstalkdInvalid:
+		delete(r.jobs, id)
+		delete(r.lastChanged, id)
+	default:
+		return false, fmt.Errorf("job %d has unknown state %d", id, rec.State)
+	}
+	return false, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// convertJobrec copies the metadata of a beanstalkd job to j.
+func convertJobrec(rec *beanstalkdJobrec, j *geanstalkd.Job) {
+	j.Priority = geanstalkd.Priority(rec.Pri)
+	j.Delay = time.Duration(rec.Delay)
+	j.TimeToRun = time.Duration(rec.TTR)
+	j.CreatedAt = time.Unix(0, rec.CreatedAt)
+	j.Stats = geanstalkd.JobStats{
+		Reserves: uint64(rec.ReserveCt),
+		Timeouts: uint64(rec.TimeoutCt),
+		Releases: uint64(rec.ReleaseCt),
+		Buries:   uint64(rec.BuryCt),
+		Kicks:    uint64(rec.KickCt),
+	}
+
+	j.RunnableAt = nil
+	switch rec.State {
+	case beanstalkdBuried:
+		j.State = geanstalkd.StateBuried
+	case beanstalkdDelayed:
+		j.State = geanstalkd.StateDelayed
+		at := time.Unix(0, rec.DeadlineAt)
+		j.RunnableAt = &at
+	default:
+		// The clients that reserved jobs are gone.
+		j.State = geanstalkd.StateReady
+	}
+}
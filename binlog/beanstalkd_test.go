@@ -0,0 +1,135 @@
+package binlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	. "testing"
+	"time"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// beanstalkdFile builds a beanstalkd binlog file.
+type beanstalkdFile struct {
+	bytes.Buffer
+}
+
+func newBeanstalkdFile(version int32) *beanstalkdFile {
+	f := new(beanstalkdFile)
+	binary.Write(f, binary.LittleEndian, version)
+	return f
+}
+
+// full writes a record with the tube name and the body.
+func (f *beanstalkdFile) full(tube string, rec beanstalkdJobrec, body string) {
+	body += "\r\n"
+	rec.BodySize = int32(len(body))
+	binary.Write(f, binary.LittleEndian, int32(len(tube)))
+	f.WriteString(tube)
+	binary.Write(f, binary.LittleEndian, rec)
+	f.WriteString(body)
+}
+
+// short writes a record which only updates the metadata of a job.
+func (f *beanstalkdFile) short(rec beanstalkdJobrec) {
+	binary.Write(f, binary.LittleEndian, int32(0))
+	binary.Write(f, binary.LittleEndian, rec)
+}
+
+func (f *beanstalkdFile) save(t *T, dir string, index int) {
+	if err := os.WriteFile(filepath.Join(dir, segmentName(index)), f.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadBeanstalkd(t *T) {
+	t.Parallel()
+
+	if size := binary.Size(beanstalkdJobrec{}); size != 80 {
+		t.Fatal("Expected the size of beanstalkd's Jobrec. Got:", size)
+	}
+
+	dir := t.TempDir()
+	created := time.Unix(1600000000, 0)
+	deadline := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	first := newBeanstalkdFile(beanstalkdVersion)
+	first.full("default", beanstalkdJobrec{ID: 1, Pri: 10, TTR: int64(time.Minute), CreatedAt: created.UnixNano(), State: beanstalkdReady}, "buried")
+	first.full("emails", beanstalkdJobrec{ID: 2, Pri: 20, State: beanstalkdReserved, ReserveCt: 1}, "reserved")
+	first.full("default", beanstalkdJobrec{ID: 3, State: beanstalkdReady}, "deleted")
+	first.full("default", beanstalkdJobrec{ID: 4, State: beanstalkdReady}, "buried first")
+	first.save(t, dir, 1)
+
+	second := newBeanstalkdFile(beanstalkdVersion)
+	second.short(beanstalkdJobrec{ID: 4, State: beanstalkdBuried, BuryCt: 1})
+	second.short(beanstalkdJobrec{ID: 1, Pri: 11, TTR: int64(time.Minute), CreatedAt: created.UnixNano(), State: beanstalkdBuried, BuryCt: 1})
+	second.short(beanstalkdJobrec{ID: 3, State: beanstalkdInvalid})
+	// An update of a job whose full record was in a deleted file.
+	second.short(beanstalkdJobrec{ID: 5, State: beanstalkdReady})
+	second.full("default", beanstalkdJobrec{ID: 6, Delay: int64(time.Hour), DeadlineAt: deadline.UnixNano(), State: beanstalkdDelayed}, "delayed")
+	// beanstalkd preallocates files with zeroes.
+	second.Write(make([]byte, 256))
+	second.save(t, dir, 2)
+
+	if err := os.WriteFile(filepath.Join(dir, "lock"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := ReadBeanstalkd(dir)
+	if err != nil {
+		t.Fatal("Could not read binlog:", err)
+	}
+	var ids []geanstalkd.JobID
+	for _, j := range jobs {
+		ids = append(ids, j.ID)
+	}
+	if len(ids) != 4 || ids[0] != 2 || ids[1] != 4 || ids[2] != 1 || ids[3] != 6 {
+		t.Fatal("Expected jobs in the order they were last changed. Got:", ids)
+	}
+
+	if j := jobs[0]; j.Tube != "emails" || j.State != geanstalkd.StateReady || string(j.Body) != "reserved" ||
+		j.Priority != 20 || j.Stats.Reserves != 1 {
+		t.Errorf("Expected the reserved job to be ready. Got: %+v", j)
+	}
+	if j := jobs[2]; j.Tube != "default" || j.State != geanstalkd.StateBuried || string(j.Body) != "buried" ||
+		j.Priority != 11 || j.TimeToRun != time.Minute || !j.CreatedAt.Equal(created) || j.Stats.Buries != 1 {
+		t.Errorf("Expected the job to be buried. Got: %+v", j)
+	}
+	if j := jobs[3]; j.State != geanstalkd.StateDelayed || j.RunnableAt == nil || !j.RunnableAt.Equal(deadline) ||
+		j.Delay != time.Hour || string(j.Body) != "delayed" {
+		t.Errorf("Expected the job to be delayed. Got: %+v", j)
+	}
+}
+
+func TestReadBeanstalkdTornRecord(t *T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	f := newBeanstalkdFile(beanstalkdVersion)
+	f.full("default", beanstalkdJobrec{ID: 1, State: beanstalkdReady}, "kept")
+	f.full("default", beanstalkdJobrec{ID: 2, State: beanstalkdReady}, "torn")
+	f.Truncate(f.Len() - 3)
+	f.save(t, dir, 1)
+
+	jobs, err := ReadBeanstalkd(dir)
+	if err != nil {
+		t.Fatal("Could not read binlog:", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != 1 {
+		t.Errorf("Expected only the first job. Got: %+v", jobs)
+	}
+}
+
+func TestReadBeanstalkdUnsupportedVersion(t *T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	newBeanstalkdFile(5).save(t, dir, 1)
+
+	if _, err := ReadBeanstalkd(dir); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Error("Expected ErrUnsupportedVersion. Got:", err)
+	}
+}
@@ -0,0 +1,168 @@
+package binlog
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// compactInterval is how often the log is compacted in the background.
+const compactInterval = time.Second
+
+func (l *Log) compactPeriodically() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Compact(); err != nil {
+				// Retrying on next tick.
+				log.Println("Could not compact binlog:", err)
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Compact deletes the oldest segments as long as they hold no live jobs. If
+// the oldest segment is mostly dead, its live jobs are first rewritten to the
+// newest segment. The lock is only held while rewriting a single job, so that
+// writes are delayed as little as possible.
+func (l *Log) Compact() error {
+	l.compactLock.Lock()
+	defer l.compactLock.Unlock()
+
+	for {
+		if err := l.removeDeadSegments(); err != nil {
+			return err
+		}
+
+		l.lock.Lock()
+		var oldest *segment
+		if len(l.segments) > 1 && l.segments[0].liveBytes*2 <= l.segments[0].size {
+			oldest = l.segments[0]
+		}
+		l.lock.Unlock()
+		if oldest == nil {
+			return nil
+		}
+
+		if err := l.migrate(oldest); err != nil {
+			return err
+		}
+	}
+}
+
+// migrate rewrites the live jobs of a segment to the current segment, one at
+// a time.
+func (l *Log) migrate(seg *segment) error {
+	for {
+		done, err := l.migrateOne(seg)
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// migrateOne rewrites one live job of a segment to the current segment.
+// Returns true if there were no live jobs left.
+func (l *Log) migrateOne(seg *segment) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var id geanstalkd.JobID
+	found := false
+	for id = range seg.jobs {
+		found = true
+		break
+	}
+	if !found || seg == l.current() {
+		return true, nil
+	}
+
+	lj := l.jobs[id]
+	body, err := l.readBody(lj)
+	if err != nil {
+		return false, err
+	}
+	j := lj.job
+	j.Body = body
+	if err := l.writeLocked(&record{opPut, j}); err != nil {
+		return false, err
+	}
+	l.report(geanstalkd.CounterBinlogRecordsMigrated, 1)
+	return false, nil
+}
+
+// ReadBody reads the body of a job in the log. Returns
+// geanstalkd.ErrJobMissing if the job has been deleted.
+func (l *Log) ReadBody(id geanstalkd.JobID) ([]byte, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	lj, ok := l.jobs[id]
+	if !ok {
+		return nil, geanstalkd.ErrJobMissing
+	}
+	return l.readBody(lj)
+}
+
+// readBody reads the body of a live job from its put record.
+func (l *Log) readBody(lj *liveJob) ([]byte, error) {
+	f, err := os.Open(filepath.Join(l.dir, segmentName(lj.segment.index)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, _, err := readRecord(io.NewSectionReader(f, lj.offset, lj.size))
+	if err != nil {
+		return nil, err
+	}
+	if r.op != opPut || r.job.ID != lj.job.ID {
+		return nil, ErrCorruptRecord
+	}
+	return r.job.Body, nil
+}
+
+// removeDeadSegments deletes the oldest segments which hold no live jobs.
+// Migrated jobs are fsynced before their old segment is deleted.
+func (l *Log) removeDeadSegments() error {
+	l.lock.Lock()
+	dead := 0
+	for dead < len(l.segments)-1 && len(l.segments[dead].jobs) == 0 {
+		dead++
+	}
+	l.lock.Unlock()
+	if dead == 0 {
+		return nil
+	}
+
+	if l.config.SyncInterval != SyncNever {
+		if err := l.syncDirty(); err != nil {
+			return err
+		}
+	}
+
+	// New jobs are only put in the current segment, so the segments stay
+	// dead.
+	l.lock.Lock()
+	removed := l.segments[:dead]
+	l.segments = l.segments[dead:]
+	l.report(geanstalkd.CounterBinlogOldestIndex, int64(l.segments[0].index-removed[0].index))
+	l.lock.Unlock()
+
+	for _, seg := range removed {
+		if err := os.Remove(filepath.Join(l.dir, segmentName(seg.index))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
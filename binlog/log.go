@@ -0,0 +1,400 @@
+// Package binlog persists jobs to disk, so that they survive a restart of the
+// server.
+//
+// Every put, delete and state change is appended to a log as a checksummed
+// record. When the log is opened, it is replayed to recover the jobs it holds.
+// A record which was only partly written when the server crashed is detected
+// by its checksum and discarded.
+//
+// The log is split into numbered segment files of a maximum size. A segment
+// is deleted once none of the jobs that were put in it are alive. Segments
+// are always deleted oldest first, so that the records of a job in newer
+// segments never outlive its put record. To keep a few long-lived jobs from
+// keeping old segments around, the live jobs of a mostly dead oldest segment
+// are rewritten to the newest segment in the background.
+package binlog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// ErrBadHeader is returned when a file in the binlog directory isn't a binlog
+// of a supported version.
+var ErrBadHeader = errors.New("not a binlog file of a supported version")
+
+// header starts every segment. Its last byte is the format version.
+const header = "geanstalkd-binlog\x01"
+
+// maxRecordSize is the largest record that will be read. Larger sizes can
+// only come from a corrupt length.
+const maxRecordSize = 1 << 30
+
+// SyncNever makes a Log never fsync its files, leaving it to the operating
+// system to write records to disk.
+const SyncNever time.Duration = -1
+
+// DefaultMaxSegmentSize is the size at which a new segment is started unless
+// configured otherwise. It is the same as beanstalkd's default.
+const DefaultMaxSegmentSize = 10 << 20
+
+// Config configures a Log.
+type Config struct {
+	// SyncInterval is how often records are fsynced in the background. If it
+	// is zero, every write is fsynced before it returns. If it is SyncNever,
+	// records are never fsynced.
+	SyncInterval time.Duration
+
+	// MaxSegmentSize is the size at which a new segment is started. Records
+	// larger than this get a segment of their own. Defaults to
+	// DefaultMaxSegmentSize.
+	MaxSegmentSize int64
+
+	// Statistics is told about written records and fsyncs. May be nil.
+	Statistics geanstalkd.StatisticsService
+}
+
+// segment is a file of the log.
+type segment struct {
+	index int
+	// size is the size of the file up to the end of the last complete
+	// record.
+	size int64
+	// jobs are the live jobs whose latest put record is in the segment.
+	jobs map[geanstalkd.JobID]struct{}
+	// liveBytes is the size of the put records of jobs.
+	liveBytes int64
+}
+
+func segmentName(index int) string {
+	return fmt.Sprintf("binlog.%d", index)
+}
+
+func (s *segment) remove(id geanstalkd.JobID, size int64) {
+	delete(s.jobs, id)
+	s.liveBytes -= size
+}
+
+// liveJob is a job which hasn't been deleted.
+type liveJob struct {
+	// job is a copy of the job as it was last written, since the registry's
+	// job is modified outside of the lock. The body isn't kept in memory, but
+	// read from the put record when needed.
+	job     geanstalkd.Job
+	segment *segment
+	// offset and size is where the job's put record is in its segment.
+	offset int64
+	size   int64
+}
+
+// Log is an append-only log of changes to jobs. Use Open to create one.
+type Log struct {
+	dir    string
+	config Config
+
+	lock sync.Mutex
+	// file is the file of the newest segment, to which records are appended.
+	file *os.File
+	// segments are ordered from oldest to newest.
+	segments []*segment
+	jobs     map[geanstalkd.JobID]*liveJob
+	// written counts the records written, so that syncDirty can tell whether
+	// records were written while it was fsyncing.
+	written uint64
+	// dirty is whether records have been written to file since the last
+	// fsync.
+	dirty bool
+	// rotated are files of older segments which haven't been fsynced since
+	// their last write.
+	rotated []*os.File
+
+	// syncLock is held while fsyncing, so that fsyncs made by compaction
+	// don't return before concurrent background fsyncs are done.
+	syncLock sync.Mutex
+	// compactLock is held while compacting, since segments are removed
+	// without holding the lock.
+	compactLock sync.Mutex
+
+	// fsync fsyncs a file. It is replaced by tests.
+	fsync func(*os.File) error
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens the log in a directory, which is created if it doesn't exist.
+// The jobs that were in the log are returned in the order they were last
+// changed. Their bodies aren't read, so that they needn't all be in memory at
+// once. Use ReadBody to read them.
+func Open(dir string, config Config) (*Log, []*geanstalkd.Job, error) {
+	if config.MaxSegmentSize <= 0 {
+		config.MaxSegmentSize = DefaultMaxSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+
+	l := &Log{
+		dir:    dir,
+		config: config,
+		jobs:   make(map[geanstalkd.JobID]*liveJob),
+		fsync:  (*os.File).Sync,
+		done:   make(chan struct{}),
+	}
+	jobs, err := l.replay()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l.report(geanstalkd.CounterBinlogOldestIndex, int64(l.segments[0].index))
+	l.report(geanstalkd.CounterBinlogCurrentIndex, int64(l.current().index))
+	l.report(geanstalkd.CounterBinlogMaxSize, config.MaxSegmentSize)
+
+	if config.SyncInterval > 0 {
+		l.wg.Add(1)
+		go l.syncPeriodically()
+	}
+	l.wg.Add(1)
+	go l.compactPeriodically()
+
+	return l, jobs, nil
+}
+
+// truncate truncates f to offset, writes b after it and leaves f positioned at
+// the end.
+func truncate(f *os.File, offset int64, b []byte) error {
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := f.Write(b)
+	return err
+}
+
+func (l *Log) report(c geanstalkd.Counter, delta int64) {
+	if l.config.Statistics != nil {
+		l.config.Statistics.Add(c, delta)
+	}
+}
+
+// current returns the segment which records are appended to.
+func (l *Log) current() *segment {
+	return l.segments[len(l.segments)-1]
+}
+
+// createSegment creates the file of a new segment and makes it the current
+// one. The previous file is returned.
+func (l *Log) createSegment(index int) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(l.dir, segmentName(index)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write([]byte(header)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l.segments = append(l.segments, &segment{
+		index: index,
+		size:  int64(len(header)),
+		jobs:  make(map[geanstalkd.JobID]struct{}),
+	})
+	previous := l.file
+	l.file = f
+	return previous, nil
+}
+
+// rotate starts a new segment. If records are fsynced in the background, the
+// previous file is fsynced and closed by the next background fsync.
+func (l *Log) rotate() error {
+	previous, err := l.createSegment(l.current().index + 1)
+	if err != nil {
+		return err
+	}
+	l.report(geanstalkd.CounterBinlogCurrentIndex, 1)
+
+	if l.config.SyncInterval > 0 {
+		l.rotated = append(l.rotated, previous)
+		return nil
+	}
+	return previous.Close()
+}
+
+// write appends a record to the log and keeps track of the live jobs.
+func (l *Log) write(r *record) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.writeLocked(r)
+}
+
+func (l *Log) writeLocked(r *record) error {
+	b := r.encode()
+	size := int64(len(b))
+	if seg := l.current(); seg.size > int64(len(header)) && seg.size+size > l.config.MaxSegmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	seg := l.current()
+	_, err := l.file.Write(b)
+	if err == nil && l.config.SyncInterval == 0 {
+		err = l.sync(l.file)
+	}
+	if err != nil {
+		// Don't leave a partial or unacknowledged record behind. Replay
+		// would stop at the former and restore the latter.
+		if terr := truncate(l.file, seg.size, nil); terr != nil {
+			return fmt.Errorf("%w (and truncating failed: %v)", err, terr)
+		}
+		return err
+	}
+	seg.size += size
+	l.report(geanstalkd.CounterBinlogRecordsWritten, 1)
+	l.written++
+	l.dirty = l.config.SyncInterval > 0
+
+	l.track(r, seg, size)
+	return nil
+}
+
+// track updates the live jobs after a record of size bytes has been written
+// to seg.
+func (l *Log) track(r *record, seg *segment, size int64) {
+	lj, live := l.jobs[r.job.ID]
+	switch r.op {
+	case opPut:
+		if live {
+			lj.segment.remove(r.job.ID, lj.size)
+		}
+		lj = &liveJob{job: r.job, segment: seg, offset: seg.size - size, size: size}
+		lj.job.Body = nil
+		l.jobs[r.job.ID] = lj
+		seg.jobs[r.job.ID] = struct{}{}
+		seg.liveBytes += size
+	case opUpdate:
+		if live {
+			lj.job = r.job
+			lj.job.Body = nil
+		}
+	case opDelete:
+		if live {
+			lj.segment.remove(r.job.ID, lj.size)
+			delete(l.jobs, r.job.ID)
+		}
+	}
+}
+
+// sync fsyncs f and reports how long it took.
+func (l *Log) sync(f *os.File) error {
+	start := time.Now()
+	if err := l.fsync(f); err != nil {
+		return err
+	}
+	l.report(geanstalkd.CounterBinlogFsyncs, 1)
+	l.report(geanstalkd.CounterBinlogFsyncNanos, int64(time.Since(start)))
+	return nil
+}
+
+// syncDirty fsyncs all records written since the last fsync. The lock isn't
+// held while fsyncing, so that writes aren't blocked. Files which couldn't be
+// fsynced are kept dirty, so that the next call retries them.
+func (l *Log) syncDirty() error {
+	l.syncLock.Lock()
+	defer l.syncLock.Unlock()
+
+	l.lock.Lock()
+	f, dirty, written := l.file, l.dirty, l.written
+	rotated := append([]*os.File(nil), l.rotated...)
+	l.lock.Unlock()
+
+	var firstErr error
+	for _, rf := range rotated {
+		if err := l.sync(rf); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		l.lock.Lock()
+		l.rotated = removeFile(l.rotated, rf)
+		l.lock.Unlock()
+		if err := rf.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if dirty {
+		// If f has been rotated since, it is fsynced again and closed by the
+		// next call.
+		if err := l.sync(f); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			l.lock.Lock()
+			if l.written == written {
+				l.dirty = false
+			}
+			l.lock.Unlock()
+		}
+	}
+	return firstErr
+}
+
+func removeFile(files []*os.File, f *os.File) []*os.File {
+	for i, other := range files {
+		if other == f {
+			return append(files[:i], files[i+1:]...)
+		}
+	}
+	return files
+}
+
+func (l *Log) syncPeriodically() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.config.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.syncDirty(); err != nil {
+				// Retrying on next tick.
+				log.Println("Could not fsync binlog:", err)
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Close fsyncs and closes the log.
+func (l *Log) Close() error {
+	close(l.done)
+	l.wg.Wait()
+
+	var err error
+	if l.config.SyncInterval != SyncNever {
+		err = l.syncDirty()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, rf := range l.rotated {
+		rf.Close()
+	}
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,424 @@
+package binlog
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	. "testing"
+	"time"
+
+	"github.com/google/btree"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/JensRantil/geanstalkd"
+	"github.com/JensRantil/geanstalkd/inmemory"
+	"github.com/JensRantil/geanstalkd/testing"
+)
+
+func TestRegistry(t *T) {
+	t.Parallel()
+
+	Convey("Given a fresh binlog Registry", t, func() {
+		log, jobs, err := Open(t.TempDir(), Config{SyncInterval: SyncNever})
+		So(err, ShouldBeNil)
+		So(jobs, ShouldBeEmpty)
+		Reset(func() { log.Close() })
+
+		testing.GenericJobRegistryTest(NewRegistry(inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize)), log))
+	})
+}
+
+// openRegistry opens the log in dir and returns the jobs in it, including
+// their bodies.
+func openRegistry(t *T, dir string) (*Registry, []*geanstalkd.Job) {
+	log, jobs, err := Open(dir, Config{SyncInterval: SyncNever})
+	if err != nil {
+		t.Fatal("Could not open binlog:", err)
+	}
+	t.Cleanup(func() { log.Close() })
+	for _, j := range jobs {
+		if j.Body != nil {
+			t.Fatal("Expected the bodies not to be replayed into memory.")
+		}
+		if j.Body, err = log.ReadBody(j.ID); err != nil {
+			t.Fatal("Could not read body:", err)
+		}
+	}
+	return NewRegistry(inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize)), log), jobs
+}
+
+func TestReplay(t *T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	r, _ := openRegistry(t, dir)
+
+	at := time.Unix(1700000000, 0)
+	created := time.Unix(1600000000, 0)
+	jobs := []*geanstalkd.Job{
+		{ID: 1, Tube: "a", Body: []byte("first"), CreatedAt: created},
+		{ID: 2, Tube: "b", Body: []byte("second"), Priority: 3, RunnableAt: &at, State: geanstalkd.StateDelayed, TimeToRun: time.Minute, Delay: time.Hour},
+		{ID: 3, Tube: "a", Body: []byte("third")},
+	}
+	for _, j := range jobs {
+		if err := r.Insert(j); err != nil {
+			t.Fatal("Could not insert job:", err)
+		}
+	}
+	buried := jobs[0].Copy()
+	buried.State = geanstalkd.StateBuried
+	buried.Stats.Buries = 1
+	if err := r.Update(&buried); err != nil {
+		t.Fatal("Could not update job:", err)
+	}
+	if err := r.DeleteByID(3); err != nil {
+		t.Fatal("Could not delete job:", err)
+	}
+
+	_, replayed := openRegistry(t, dir)
+	if len(replayed) != 2 {
+		t.Fatal("Expected two jobs. Got:", len(replayed))
+	}
+	// Ordered by last change.
+	if got := replayed[0]; got.ID != 2 || string(got.Body) != "second" || got.Priority != 3 ||
+		!got.RunnableAt.Equal(at) || got.TimeToRun != time.Minute || got.Delay != time.Hour || got.Tube != "b" {
+		t.Errorf("Unexpected delayed job: %+v", got)
+	}
+	if got := replayed[1]; got.ID != 1 || string(got.Body) != "first" || got.State != geanstalkd.StateBuried ||
+		got.Stats.Buries != 1 || !got.CreatedAt.Equal(created) || got.RunnableAt != nil {
+		t.Errorf("Unexpected buried job: %+v", got)
+	}
+}
+
+func TestRegistryLogsSpilledBodies(t *T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	log, _, err := Open(dir, Config{SyncInterval: SyncNever})
+	if err != nil {
+		t.Fatal("Could not open binlog:", err)
+	}
+	jobs := geanstalkd.NewSpillingJobRegistry(inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize)))
+	j := &geanstalkd.Job{ID: 1, Body: []byte("spilled"), BodyRef: &geanstalkd.BodyRef{Size: 7}}
+	if err := NewRegistry(jobs, log).Insert(j); err != nil {
+		t.Fatal("Could not insert job:", err)
+	}
+	if j.Body != nil {
+		t.Fatal("Expected the spilled body to be dropped.")
+	}
+	if _, err := log.ReadBody(2); err != geanstalkd.ErrJobMissing {
+		t.Error("Expected ErrJobMissing. Got:", err)
+	}
+	log.Close()
+
+	_, replayed := openRegistry(t, dir)
+	if len(replayed) != 1 || string(replayed[0].Body) != "spilled" {
+		t.Errorf("Expected the body to be logged. Got: %+v", replayed)
+	}
+}
+
+func TestReplayDiscardsTornRecord(t *T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	r, _ := openRegistry(t, dir)
+	if err := r.Insert(&geanstalkd.Job{ID: 1, Body: []byte("kept")}); err != nil {
+		t.Fatal("Could not insert job:", err)
+	}
+	if err := r.Insert(&geanstalkd.Job{ID: 2, Body: []byte("torn")}); err != nil {
+		t.Fatal("Could not insert job:", err)
+	}
+
+	// Simulate a crash in the middle of writing the last record.
+	path := filepath.Join(dir, segmentName(1))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	r2, replayed := openRegistry(t, dir)
+	if len(replayed) != 1 || replayed[0].ID != 1 {
+		t.Fatalf("Expected only the first job. Got: %+v", replayed)
+	}
+
+	// New records must be readable after the discarded one.
+	if err := r2.Insert(&geanstalkd.Job{ID: 3, Body: []byte("new")}); err != nil {
+		t.Fatal("Could not insert job:", err)
+	}
+	_, replayed = openRegistry(t, dir)
+	if len(replayed) != 2 || replayed[1].ID != 3 || string(replayed[1].Body) != "new" {
+		t.Errorf("Expected the first and the new job. Got: %+v", replayed)
+	}
+}
+
+func TestReplayDiscardsCorruptRecord(t *T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	r, _ := openRegistry(t, dir)
+	if err := r.Insert(&geanstalkd.Job{ID: 1, Body: []byte("corrupt")}); err != nil {
+		t.Fatal("Could not insert job:", err)
+	}
+
+	path := filepath.Join(dir, segmentName(1))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, replayed := openRegistry(t, dir); len(replayed) != 0 {
+		t.Errorf("Expected no jobs. Got: %+v", replayed)
+	}
+}
+
+func TestOpenRejectsCorruptRecordInOlderSegment(t *T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	log, _, err := Open(dir, Config{SyncInterval: SyncNever, MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatal("Could not open binlog:", err)
+	}
+	r := NewRegistry(inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize)), log)
+	for id := geanstalkd.JobID(1); id <= 3; id++ {
+		if err := r.Insert(&geanstalkd.Job{ID: id, Body: []byte("a body which fills a segment")}); err != nil {
+			t.Fatal("Could not insert job:", err)
+		}
+	}
+	log.Close()
+	if indexes, err := segmentIndexes(dir); err != nil || len(indexes) != 3 {
+		t.Fatal("Expected three segments. Got:", indexes, err)
+	}
+
+	// The record is at the end of its segment, but later segments have
+	// records which were acknowledged after it.
+	path := filepath.Join(dir, segmentName(1))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if log, _, err := Open(dir, Config{SyncInterval: SyncNever}); !errors.Is(err, ErrCorruptRecord) {
+		if err == nil {
+			log.Close()
+		}
+		t.Error("Expected ErrCorruptRecord. Got:", err)
+	}
+}
+
+func TestOpenRejectsOtherFiles(t *T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, segmentName(1)), []byte("not a binlog at all"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Open(dir, Config{SyncInterval: SyncNever}); err == nil {
+		t.Error("Expected an error.")
+	}
+}
+
+func TestSyncEveryWrite(t *T) {
+	t.Parallel()
+
+	stats := geanstalkd.NewMapStatisticsService()
+	log, _, err := Open(t.TempDir(), Config{Statistics: stats})
+	if err != nil {
+		t.Fatal("Could not open binlog:", err)
+	}
+	defer log.Close()
+
+	r := NewRegistry(inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize)), log)
+	for id := geanstalkd.JobID(1); id <= 3; id++ {
+		if err := r.Insert(&geanstalkd.Job{ID: id}); err != nil {
+			t.Fatal("Could not insert job:", err)
+		}
+	}
+	if fsyncs := stats.Get(geanstalkd.CounterBinlogFsyncs); fsyncs != 3 {
+		t.Error("Expected an fsync per write. Got:", fsyncs)
+	}
+	if nanos := stats.Get(geanstalkd.CounterBinlogFsyncNanos); nanos <= 0 {
+		t.Error("Expected fsync time to be measured. Got:", nanos)
+	}
+}
+
+func TestSyncPeriodically(t *T) {
+	t.Parallel()
+
+	stats := geanstalkd.NewMapStatisticsService()
+	log, _, err := Open(t.TempDir(), Config{SyncInterval: time.Millisecond, Statistics: stats})
+	if err != nil {
+		t.Fatal("Could not open binlog:", err)
+	}
+	defer log.Close()
+
+	r := NewRegistry(inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize)), log)
+	if err := r.Insert(&geanstalkd.Job{ID: 1}); err != nil {
+		t.Fatal("Could not insert job:", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for stats.Get(geanstalkd.CounterBinlogFsyncs) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the write to be fsynced in the background.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if fsyncs := stats.Get(geanstalkd.CounterBinlogFsyncs); fsyncs != 1 {
+		t.Error("Expected no fsync without writes. Got:", fsyncs)
+	}
+}
+
+func TestSyncRetriesFailedFsyncs(t *T) {
+	t.Parallel()
+
+	log, _, err := Open(t.TempDir(), Config{SyncInterval: time.Hour, MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatal("Could not open binlog:", err)
+	}
+	defer log.Close()
+	setFsync := func(fsync func(*os.File) error) {
+		log.syncLock.Lock()
+		defer log.syncLock.Unlock()
+		log.fsync = fsync
+	}
+	var synced []*os.File
+	setFsync(func(f *os.File) error { return errors.New("fsync failed") })
+
+	// The second job starts a new segment.
+	r := NewRegistry(inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize)), log)
+	for id := geanstalkd.JobID(1); id <= 2; id++ {
+		if err := r.Insert(&geanstalkd.Job{ID: id, Body: []byte("a body which fills a segment")}); err != nil {
+			t.Fatal("Could not insert job:", err)
+		}
+	}
+	if err := log.syncDirty(); err == nil {
+		t.Fatal("Expected the fsync to fail.")
+	}
+	if !log.dirty || len(log.rotated) != 1 {
+		t.Fatal("Expected the files to be kept for the next fsync.")
+	}
+	if _, err := log.rotated[0].Stat(); err != nil {
+		t.Fatal("Expected the rotated file to be open. Got:", err)
+	}
+
+	setFsync(func(f *os.File) error {
+		synced = append(synced, f)
+		return f.Sync()
+	})
+	if err := log.syncDirty(); err != nil {
+		t.Fatal("Could not fsync:", err)
+	}
+	if len(synced) != 2 {
+		t.Error("Expected both files to be fsynced. Got:", len(synced))
+	}
+	if log.dirty || len(log.rotated) != 0 {
+		t.Error("Expected no files left to fsync.")
+	}
+}
+
+func TestCompactMigratesLongLivedJobs(t *T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	stats := geanstalkd.NewMapStatisticsService()
+	log, _, err := Open(dir, Config{SyncInterval: SyncNever, MaxSegmentSize: 256, Statistics: stats})
+	if err != nil {
+		t.Fatal("Could not open binlog:", err)
+	}
+	r := NewRegistry(inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize)), log)
+
+	if err := r.Insert(&geanstalkd.Job{ID: 1, Body: []byte("long-lived")}); err != nil {
+		t.Fatal("Could not insert job:", err)
+	}
+	for id := geanstalkd.JobID(2); id <= 20; id++ {
+		if err := r.Insert(&geanstalkd.Job{ID: id, Body: []byte("short-lived")}); err != nil {
+			t.Fatal("Could not insert job:", err)
+		}
+		if err := r.DeleteByID(id); err != nil {
+			t.Fatal("Could not delete job:", err)
+		}
+	}
+	if indexes, _ := segmentIndexes(dir); len(indexes) < 3 {
+		t.Fatal("Expected several segments. Got:", indexes)
+	}
+
+	if err := log.Compact(); err != nil {
+		t.Fatal("Could not compact:", err)
+	}
+	indexes, err := segmentIndexes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 1 {
+		t.Error("Expected only the current segment to be left. Got:", indexes)
+	}
+	if migrated := stats.Get(geanstalkd.CounterBinlogRecordsMigrated); migrated != 1 {
+		t.Error("Expected the long-lived job to be migrated. Got:", migrated)
+	}
+	if oldest := stats.Get(geanstalkd.CounterBinlogOldestIndex); oldest != int64(indexes[0]) {
+		t.Error("Expected the oldest index to be reported. Got:", oldest)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal("Could not close binlog:", err)
+	}
+
+	_, replayed := openRegistry(t, dir)
+	if len(replayed) != 1 || replayed[0].ID != 1 || string(replayed[0].Body) != "long-lived" {
+		t.Errorf("Expected only the long-lived job. Got: %+v", replayed)
+	}
+}
+
+func TestCompactKeepsLiveSegments(t *T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	stats := geanstalkd.NewMapStatisticsService()
+	log, _, err := Open(dir, Config{SyncInterval: SyncNever, MaxSegmentSize: 256, Statistics: stats})
+	if err != nil {
+		t.Fatal("Could not open binlog:", err)
+	}
+	r := NewRegistry(inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize)), log)
+
+	for id := geanstalkd.JobID(1); id <= 10; id++ {
+		if err := r.Insert(&geanstalkd.Job{ID: id, Body: []byte("live")}); err != nil {
+			t.Fatal("Could not insert job:", err)
+		}
+	}
+	before, _ := segmentIndexes(dir)
+
+	if err := log.Compact(); err != nil {
+		t.Fatal("Could not compact:", err)
+	}
+	if after, _ := segmentIndexes(dir); len(after) != len(before) {
+		t.Errorf("Expected no segment to be removed. Before: %v, after: %v", before, after)
+	}
+	if migrated := stats.Get(geanstalkd.CounterBinlogRecordsMigrated); migrated != 0 {
+		t.Error("Expected no job to be migrated. Got:", migrated)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal("Could not close binlog:", err)
+	}
+
+	_, replayed := openRegistry(t, dir)
+	if len(replayed) != 10 {
+		t.Fatal("Expected all jobs. Got:", len(replayed))
+	}
+	for i, j := range replayed {
+		if j.ID != geanstalkd.JobID(i+1) {
+			t.Errorf("Expected job %d at position %d. Got: %d", i+1, i, j.ID)
+		}
+	}
+}
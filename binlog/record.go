@@ -0,0 +1,196 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// ErrCorruptRecord is returned when a record has a bad checksum or can't be
+// decoded.
+var ErrCorruptRecord = errors.New("corrupt binlog record")
+
+type op byte
+
+// The kinds of records in a binlog.
+const (
+	// opPut stores a new job, including its body.
+	opPut op = iota + 1
+	// opUpdate stores the metadata of a job whose body already has been
+	// stored by an opPut record.
+	opUpdate
+	// opDelete deletes a job.
+	opDelete
+)
+
+// record is a single entry in a binlog. Only ID is set for opDelete.
+type record struct {
+	op  op
+	job geanstalkd.Job
+}
+
+// recordHeaderSize is the size of the length and the checksum preceding every
+// record.
+const recordHeaderSize = 8
+
+// encoder appends the fields of a record to a byte slice.
+type encoder []byte
+
+func (e *encoder) uint8(v uint8) {
+	*e = append(*e, v)
+}
+
+func (e *encoder) uint64(v uint64) {
+	*e = binary.BigEndian.AppendUint64(*e, v)
+}
+
+func (e *encoder) time(t time.Time) {
+	if t.IsZero() {
+		e.uint64(0)
+		return
+	}
+	e.uint64(uint64(t.UnixNano()))
+}
+
+func (e *encoder) bytes(b []byte) {
+	*e = binary.BigEndian.AppendUint32(*e, uint32(len(b)))
+	*e = append(*e, b...)
+}
+
+// encode returns the record, prefixed with its length and checksum.
+func (r *record) encode() []byte {
+	e := make(encoder, recordHeaderSize, recordHeaderSize+64+len(r.job.Tube)+len(r.job.Body))
+	e.uint8(uint8(r.op))
+	e.uint64(uint64(r.job.ID))
+
+	if r.op != opDelete {
+		j := &r.job
+		e.bytes([]byte(j.Tube))
+		e.uint8(uint8(j.State))
+		e.uint64(uint64(j.Priority))
+		if j.RunnableAt != nil {
+			e.time(*j.RunnableAt)
+		} else {
+			e.time(time.Time{})
+		}
+		e.uint64(uint64(j.TimeToRun))
+		e.time(j.CreatedAt)
+		e.uint64(uint64(j.Delay))
+		e.uint64(j.Stats.Reserves)
+		e.uint64(j.Stats.Timeouts)
+		e.uint64(j.Stats.Releases)
+		e.uint64(j.Stats.Buries)
+		e.uint64(j.Stats.Kicks)
+		if r.op == opPut {
+			e.bytes(j.Body)
+		}
+	}
+
+	binary.BigEndian.PutUint32(e[0:4], uint32(len(e)-recordHeaderSize))
+	binary.BigEndian.PutUint32(e[4:8], crc32.ChecksumIEEE(e[recordHeaderSize:]))
+	return e
+}
+
+// decoder reads the fields of a record from a byte slice. Reading past the end
+// sets err.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = ErrCorruptRecord
+		return make([]byte, n)
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) uint8() uint8 {
+	return d.next(1)[0]
+}
+
+func (d *decoder) uint64() uint64 {
+	return binary.BigEndian.Uint64(d.next(8))
+}
+
+func (d *decoder) time() time.Time {
+	if nanos := d.uint64(); nanos != 0 {
+		return time.Unix(0, int64(nanos))
+	}
+	return time.Time{}
+}
+
+func (d *decoder) bytes() []byte {
+	n := binary.BigEndian.Uint32(d.next(4))
+	if n > math.MaxInt32 {
+		d.err = ErrCorruptRecord
+		return nil
+	}
+	b := d.next(int(n))
+	return append([]byte(nil), b...)
+}
+
+// readRecord reads the next record from r. Returns io.EOF if there are no
+// more records and ErrCorruptRecord if the record is incomplete or corrupt,
+// which happens if the server crashed while writing it.
+func readRecord(r io.Reader) (*record, int, error) {
+	var header [recordHeaderSize]byte
+	if n, err := io.ReadFull(r, header[:]); err == io.EOF {
+		return nil, 0, io.EOF
+	} else if err != nil {
+		return nil, n, ErrCorruptRecord
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return nil, recordHeaderSize, ErrCorruptRecord
+	}
+	payload := make([]byte, size)
+	if n, err := io.ReadFull(r, payload); err != nil {
+		return nil, recordHeaderSize + n, ErrCorruptRecord
+	}
+	read := recordHeaderSize + int(size)
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, read, ErrCorruptRecord
+	}
+
+	d := &decoder{b: payload}
+	rec := &record{op: op(d.uint8())}
+	rec.job.ID = geanstalkd.JobID(d.uint64())
+	switch rec.op {
+	case opDelete:
+	case opPut, opUpdate:
+		j := &rec.job
+		j.Tube = geanstalkd.Tube(d.bytes())
+		j.State = geanstalkd.JobState(d.uint8())
+		j.Priority = geanstalkd.Priority(d.uint64())
+		if runnableAt := d.time(); !runnableAt.IsZero() {
+			j.RunnableAt = &runnableAt
+		}
+		j.TimeToRun = time.Duration(d.uint64())
+		j.CreatedAt = d.time()
+		j.Delay = time.Duration(d.uint64())
+		j.Stats.Reserves = d.uint64()
+		j.Stats.Timeouts = d.uint64()
+		j.Stats.Releases = d.uint64()
+		j.Stats.Buries = d.uint64()
+		j.Stats.Kicks = d.uint64()
+		if rec.op == opPut {
+			j.Body = d.bytes()
+		}
+	default:
+		return nil, read, ErrCorruptRecord
+	}
+	if d.err != nil || len(d.b) != 0 {
+		return nil, read, ErrCorruptRecord
+	}
+	return rec, read, nil
+}
@@ -0,0 +1,50 @@
+package binlog
+
+import (
+	"github.com/JensRantil/geanstalkd"
+)
+
+// Registry is a JobRegistry which writes every change made to another
+// JobRegistry to a Log. Use NewRegistry to create one.
+type Registry struct {
+	geanstalkd.JobRegistry
+
+	log *Log
+}
+
+// NewRegistry creates a new Registry which stores jobs in jobs and logs them
+// to log.
+func NewRegistry(jobs geanstalkd.JobRegistry, log *Log) *Registry {
+	return &Registry{jobs, log}
+}
+
+// Insert stores a new job and logs it, including its body. If logging fails,
+// the job isn't stored.
+func (r *Registry) Insert(j *geanstalkd.Job) error {
+	// The other JobRegistry might move the body out of j.
+	logged := *j
+	if err := r.JobRegistry.Insert(j); err != nil {
+		return err
+	}
+	if err := r.log.write(&record{opPut, logged}); err != nil {
+		r.JobRegistry.DeleteByID(j.ID)
+		return err
+	}
+	return nil
+}
+
+// Update updates a job and logs its new metadata.
+func (r *Registry) Update(j *geanstalkd.Job) error {
+	if err := r.JobRegistry.Update(j); err != nil {
+		return err
+	}
+	return r.log.write(&record{opUpdate, *j})
+}
+
+// DeleteByID deletes a job and logs the deletion.
+func (r *Registry) DeleteByID(id geanstalkd.JobID) error {
+	if err := r.JobRegistry.DeleteByID(id); err != nil {
+		return err
+	}
+	return r.log.write(&record{op: opDelete, job: geanstalkd.Job{ID: id}})
+}
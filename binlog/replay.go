@@ -0,0 +1,150 @@
+package binlog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// segmentIndexes returns the indexes of the segments in dir, in ascending
+// order.
+func segmentIndexes(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []int
+	for _, e := range entries {
+		suffix := strings.TrimPrefix(e.Name(), "binlog.")
+		if suffix == e.Name() || e.IsDir() {
+			continue
+		}
+		if index, err := strconv.Atoi(suffix); err == nil && index > 0 && segmentName(index) == e.Name() {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
+
+// replay reads all segments in the log directory, keeps track of the live
+// jobs and opens the newest segment for appending. Returns the live jobs
+// without their bodies, ordered by when they were last changed.
+func (l *Log) replay() ([]*geanstalkd.Job, error) {
+	indexes, err := segmentIndexes(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &replayState{lastChanged: make(map[geanstalkd.JobID]int)}
+	for i, index := range indexes {
+		path := filepath.Join(l.dir, segmentName(index))
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			l.closeReplayed()
+			return nil, err
+		}
+
+		seg := &segment{index: index, jobs: make(map[geanstalkd.JobID]struct{})}
+		l.segments = append(l.segments, seg)
+		if err := l.replaySegment(f, seg, state, i == len(indexes)-1); err != nil {
+			f.Close()
+			l.closeReplayed()
+			return nil, fmt.Errorf("replaying %s: %w", path, err)
+		}
+
+		if i == len(indexes)-1 {
+			l.file = f
+		} else if err := f.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.file == nil {
+		if _, err := l.createSegment(1); err != nil {
+			return nil, err
+		}
+	}
+
+	jobs := make([]*geanstalkd.Job, 0, len(l.jobs))
+	for _, lj := range l.jobs {
+		job := lj.job
+		jobs = append(jobs, &job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return state.lastChanged[jobs[i].ID] < state.lastChanged[jobs[j].ID] })
+	return jobs, nil
+}
+
+func (l *Log) closeReplayed() {
+	if l.file != nil {
+		l.file.Close()
+	}
+}
+
+// replayState is what replay keeps track of while reading the segments.
+type replayState struct {
+	seq int
+	// lastChanged is the seq of the last record of every live job.
+	lastChanged map[geanstalkd.JobID]int
+}
+
+// replaySegment reads the records of a segment. The file is truncated after
+// the last valid record, and left positioned there. Only the last segment may
+// end with a torn record. Any other corrupt record is an error, since records
+// after it have been acknowledged.
+func (l *Log) replaySegment(f *os.File, seg *segment, state *replayState, last bool) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < int64(len(header)) {
+		if !last {
+			return ErrBadHeader
+		}
+		// The header was never fully written.
+		seg.size = int64(len(header))
+		return truncate(f, 0, []byte(header))
+	}
+
+	r := bufio.NewReader(f)
+	var magic [len(header)]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return err
+	}
+	if string(magic[:]) != header {
+		return ErrBadHeader
+	}
+
+	seg.size = int64(len(header))
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		} else if err == ErrCorruptRecord && last && seg.size+int64(n) == info.Size() {
+			// The server crashed while writing the record. It was never
+			// acknowledged.
+			break
+		} else if err == ErrCorruptRecord {
+			return fmt.Errorf("record at offset %d: %w", seg.size, err)
+		} else if err != nil {
+			return err
+		}
+		seg.size += int64(n)
+
+		if _, live := l.jobs[rec.job.ID]; live || rec.op == opPut {
+			l.track(rec, seg, int64(n))
+			state.lastChanged[rec.job.ID] = state.seq
+			state.seq++
+		}
+	}
+
+	return truncate(f, seg.size, nil)
+}
@@ -0,0 +1,39 @@
+package geanstalkd
+
+// BodyRef refers to a body stored in a BodyStore.
+type BodyRef struct {
+	// File and Offset is where the BodyStore keeps the body.
+	File   uint32
+	Offset int64
+	Size   int
+}
+
+// SpillingJobRegistry is a JobRegistry which drops the bodies of jobs spilled
+// to a BodyStore before storing them in another JobRegistry, so that only
+// their BodyRef is kept there. Bodies are spilled by StorageService.Spill.
+// Use NewSpillingJobRegistry to create one.
+type SpillingJobRegistry struct {
+	JobRegistry
+}
+
+// NewSpillingJobRegistry creates a SpillingJobRegistry which stores jobs in
+// jobs.
+func NewSpillingJobRegistry(jobs JobRegistry) *SpillingJobRegistry {
+	return &SpillingJobRegistry{jobs}
+}
+
+// Insert stores a new job. The body of a spilled job is dropped, which
+// modifies j.
+func (r *SpillingJobRegistry) Insert(j *Job) error {
+	if j.BodyRef == nil {
+		return r.JobRegistry.Insert(j)
+	}
+
+	body := j.Body
+	j.Body = nil
+	if err := r.JobRegistry.Insert(j); err != nil {
+		j.Body = body
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package geanstalkd_test
+
+import (
+	"io"
+
+	"github.com/google/btree"
+
+	"github.com/JensRantil/geanstalkd"
+	"github.com/JensRantil/geanstalkd/inmemory"
+	"github.com/JensRantil/geanstalkd/ondisk"
+
+	. "testing"
+)
+
+// newSpillingStorage creates a storage which spills bodies of at least six
+// bytes, each to its own file.
+func newSpillingStorage(t *T) *geanstalkd.LockService {
+	bodies, err := ondisk.OpenBodyStore(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal("Could not open body store:", err)
+	}
+	t.Cleanup(func() { bodies.Close() })
+	return geanstalkd.NewLockService(&geanstalkd.StorageService{
+		Jobs:                 geanstalkd.NewSpillingJobRegistry(inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize))),
+		DelayTubes:           inmemory.NewTubeHeapPriorityQueue(),
+		NewJobPriorityQueue:  func() geanstalkd.JobPriorityQueue { return inmemory.NewJobHeapPriorityQueue() },
+		NewJobQueue:          func() geanstalkd.JobQueue { return inmemory.NewJobListQueue() },
+		NewTubePriorityQueue: func() geanstalkd.TubePriorityQueue { return inmemory.NewTubeHeapPriorityQueue() },
+		Bodies:               bodies,
+		SpillSize:            6,
+	})
+}
+
+func addSpilled(t *T, storage *geanstalkd.LockService, j *geanstalkd.Job) {
+	if err := storage.Spill(j); err != nil {
+		t.Fatal("Could not spill body:", err)
+	}
+	if err := storage.Add(j); err != nil {
+		t.Fatal("Could not add job:", err)
+	}
+}
+
+func TestSpill(t *T) {
+	t.Parallel()
+
+	storage := newSpillingStorage(t)
+	addSpilled(t, storage, &geanstalkd.Job{ID: 1, Tube: "a", Body: []byte("small")})
+	addSpilled(t, storage, &geanstalkd.Job{ID: 2, Tube: "a", Body: []byte("spilled")})
+
+	small, err := storage.Read(1)
+	if err != nil || small.BodyRef != nil || string(small.Body) != "small" {
+		t.Fatal("Expected the small body to be kept in memory. Got:", small, err)
+	}
+	spilled, err := storage.Read(2)
+	if err != nil || spilled.BodyRef == nil || spilled.Body != nil {
+		t.Fatal("Expected only the BodyRef to be stored. Got:", spilled, err)
+	}
+	r, err := storage.OpenBody(spilled)
+	if err != nil {
+		t.Fatal("Could not open body:", err)
+	}
+	body, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(body) != "spilled" {
+		t.Errorf("Unexpected body: %q, %v", body, err)
+	}
+}
+
+func TestOpenBodyOfDeletedJob(t *T) {
+	t.Parallel()
+
+	storage := newSpillingStorage(t)
+	addSpilled(t, storage, &geanstalkd.Job{ID: 1, Tube: "a", Body: []byte("opened")})
+	addSpilled(t, storage, &geanstalkd.Job{ID: 2, Tube: "a", Body: []byte("deleted")})
+
+	// A body opened before its job is deleted can still be read, even though
+	// its file is removed.
+	opened, err := storage.Read(1)
+	if err != nil {
+		t.Fatal("Could not read job:", err)
+	}
+	r, err := storage.OpenBody(opened)
+	if err != nil {
+		t.Fatal("Could not open body:", err)
+	}
+	defer r.Close()
+
+	// A job deleted after being peeked, but before its body is opened.
+	deleted, err := storage.Read(2)
+	if err != nil {
+		t.Fatal("Could not read job:", err)
+	}
+	for _, id := range []geanstalkd.JobID{1, 2} {
+		if err := storage.DeleteByID(0, id); err != nil {
+			t.Fatal("Could not delete job:", err)
+		}
+	}
+	if _, err := storage.OpenBody(deleted); err != geanstalkd.ErrJobMissing {
+		t.Error("Expected ErrJobMissing. Got:", err)
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil || string(body) != "opened" {
+		t.Errorf("Unexpected body: %q, %v", body, err)
+	}
+}
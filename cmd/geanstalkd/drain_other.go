@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "github.com/JensRantil/geanstalkd"
+
+// drainOnSignal does nothing, since there is no SIGUSR1 on this platform. Use
+// the drain command instead.
+func drainOnSignal(srv *geanstalkd.Server) {}
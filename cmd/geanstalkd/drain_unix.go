@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// drainOnSignal puts the server in draining mode on SIGUSR1, like beanstalkd.
+func drainOnSignal(srv *geanstalkd.Server) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			log.Println("Received SIGUSR1. Draining.")
+			srv.SetDraining(true)
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/JensRantil/geanstalkd"
+	"github.com/JensRantil/geanstalkd/binlog"
+	"github.com/JensRantil/geanstalkd/inmemory"
+	"github.com/google/btree"
+)
+
+// importBeanstalkd reads the jobs in a beanstalkd binlog directory and adds
+// them using add. Jobs with IDs that already exist are skipped. Returns the
+// number of jobs added.
+func importBeanstalkd(dir string, add func(*geanstalkd.Job) error) (int, error) {
+	jobs, err := binlog.ReadBeanstalkd(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, j := range jobs {
+		if err := add(j); err == geanstalkd.ErrJobAlreadyExist {
+			log.Println("Skipping job", j.ID, "since a job with the same ID already exists.")
+		} else if err != nil {
+			return added, fmt.Errorf("adding job %d: %w", j.ID, err)
+		} else {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// runImport implements the import subcommand, which adds the jobs in a
+// beanstalkd binlog directory to a geanstalkd binlog.
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dir := flags.String("b", "", "add the jobs to the binlog in `dir`")
+	size := flags.Int64("s", binlog.DefaultMaxSegmentSize, "start a new binlog file after `bytes` bytes")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: geanstalkd import -b dir beanstalkd-dir")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *dir == "" || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	binlogFile, existing, err := binlog.Open(*dir, binlog.Config{
+		SyncInterval:   time.Second,
+		MaxSegmentSize: *size,
+	})
+	if err != nil {
+		log.Fatalln("Could not open binlog:", err)
+	}
+	jobs := inmemory.NewBTreeJobRegistry(btree.New(DefaultBTreeDegree))
+	for _, j := range existing {
+		if err := jobs.Insert(j); err != nil {
+			log.Fatalln("Could not restore job", j.ID, "from binlog:", err)
+		}
+	}
+
+	added, err := importBeanstalkd(flags.Arg(0), binlog.NewRegistry(jobs, binlogFile).Insert)
+	if cerr := binlogFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatalln("Could not import jobs:", err)
+	}
+	log.Println("Imported", added, "jobs.")
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"context"
+	"flag"
+	"log"
 	gonet "net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"time"
 
 	"github.com/JensRantil/geanstalkd"
+	"github.com/JensRantil/geanstalkd/binlog"
 	"github.com/JensRantil/geanstalkd/inmemory"
 	"github.com/JensRantil/geanstalkd/net"
+	"github.com/JensRantil/geanstalkd/ondisk"
 	"github.com/google/btree"
 )
 
@@ -36,21 +42,192 @@ func cancelOnInterrupt(ctx context.Context, cancel func()) {
 // DefaultBTreeDegree is the maximum number of items a BTree node holds.
 const DefaultBTreeDegree = 16
 
+var (
+	exitWhenDrained = flag.Bool("drain-exit", false, "exit once draining and all jobs are gone")
+	binlogDir       = flag.String("b", "", "persist jobs to a binlog in `dir`")
+	fsyncMillis     = flag.Int("f", 50, "fsync the binlog at most every `ms` milliseconds. 0 fsyncs before acknowledging every write")
+	neverFsync      = flag.Bool("F", false, "never fsync the binlog")
+	binlogSize      = flag.Int64("s", binlog.DefaultMaxSegmentSize, "start a new binlog file after `bytes` bytes")
+	importDir       = flag.String("import", "", "import the jobs in the beanstalkd binlog in `dir` at startup. Only once: refused if the -b binlog already exists")
+	spillDir        = flag.String("spill", "", "keep large job bodies in files in `dir` instead of in memory")
+	spillSize       = flag.Int("spill-size", 64<<10, "keep job bodies of at least `bytes` bytes out of memory when -spill is given")
+	maxJobSize      = flag.Int("z", geanstalkd.DefaultMaxJobSize, "reject jobs larger than `bytes` bytes")
+	maxMemory       = flag.Int64("max-memory", 0, "reject new jobs once the job bodies in memory use `bytes` bytes. 0 means no limit")
+	onDiskDir       = flag.String("ondisk", "", "keep jobs and queues in files in `dir` instead of in memory. They are only kept across restarts by -b")
+)
+
+// openJobRegistry opens an on-disk JobRegistry in dir. A registry left behind
+// by a previous run is removed, since the jobs are restored from the binlog.
+func openJobRegistry(dir string) (*ondisk.JobRegistry, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "jobs")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return ondisk.OpenJobRegistry(path, 0)
+}
+
+// isEmptyDir returns whether dir is missing or holds no files.
+func isEmptyDir(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return len(entries) == 0, err
+}
+
+// cancelWhenDrained stops the server once it is draining and holds no jobs.
+func cancelWhenDrained(ctx context.Context, cancel func(), srv *geanstalkd.Server) {
+	go func() {
+		if err := srv.WaitDrained(ctx); err == nil {
+			log.Println("All jobs drained. Exiting.")
+			cancel()
+		}
+	}()
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+	flag.Parse()
+
 	ctx, cancel := context.WithCancel(context.Background())
 	cancelOnInterrupt(ctx, cancel)
 
-	ids := geanstalkd.GenerateIds(ctx)
+	stats := geanstalkd.NewMapStatisticsService()
+	var memory *geanstalkd.MemoryBudget
+	if *maxMemory > 0 {
+		memory = geanstalkd.NewMemoryBudget(*maxMemory)
+	}
+	var jobs geanstalkd.JobRegistry = inmemory.NewBTreeJobRegistry(btree.New(DefaultBTreeDegree))
+	storedMemory := memory
+	if *onDiskDir != "" {
+		registry, err := openJobRegistry(*onDiskDir)
+		if err != nil {
+			log.Fatalln("Could not open job registry:", err)
+		}
+		defer registry.Close()
+		jobs = registry
+		// Stored bodies are kept in the registry's file. The budget still
+		// limits the bodies being received.
+		storedMemory = nil
+	}
+	var bodies geanstalkd.BodyStore
+	if *spillDir != "" {
+		bodyStore, err := ondisk.OpenBodyStore(*spillDir, 0)
+		if err != nil {
+			log.Fatalln("Could not open body store:", err)
+		}
+		defer bodyStore.Close()
+		bodies = bodyStore
+		jobs = geanstalkd.NewSpillingJobRegistry(jobs)
+	}
+	newJobPriorityQueue := func() geanstalkd.JobPriorityQueue { return inmemory.NewJobHeapPriorityQueue() }
+	if *onDiskDir != "" {
+		index, err := ondisk.OpenQueueIndex(filepath.Join(*onDiskDir, "queues"), jobs, 0)
+		if err != nil {
+			log.Fatalln("Could not open queue index:", err)
+		}
+		defer index.Close()
+		newJobPriorityQueue = func() geanstalkd.JobPriorityQueue { return index.NewJobPriorityQueue() }
+	}
+	storageService := &geanstalkd.StorageService{
+		Jobs:                 jobs,
+		DelayTubes:           inmemory.NewTubeHeapPriorityQueue(),
+		NewJobPriorityQueue:  newJobPriorityQueue,
+		NewJobQueue:          func() geanstalkd.JobQueue { return inmemory.NewJobListQueue() },
+		NewTubePriorityQueue: func() geanstalkd.TubePriorityQueue { return inmemory.NewTubeHeapPriorityQueue() },
+		Statistics:           stats,
+		Memory:               storedMemory,
+		Bodies:               bodies,
+		SpillSize:            *spillSize,
+	}
+	// restore spills the body of a job before restoring it, so that only one
+	// large body at a time is in memory.
+	restore := func(j *geanstalkd.Job) error {
+		if err := storageService.Spill(j); err != nil {
+			return err
+		}
+		return storageService.Restore(j)
+	}
+	if *importDir != "" && *binlogDir != "" {
+		// Importing into an existing binlog would bring back jobs that were
+		// imported, and since deleted, on an earlier start. Use the import
+		// subcommand to add jobs to an existing binlog.
+		empty, err := isEmptyDir(*binlogDir)
+		if err != nil {
+			log.Fatalln("Could not read binlog directory:", err)
+		}
+		if !empty {
+			log.Fatalln("Refusing to -import into the existing binlog in", *binlogDir+". Start without -import to use it.")
+		}
+	}
+	if *binlogDir != "" {
+		syncInterval := time.Duration(*fsyncMillis) * time.Millisecond
+		if *neverFsync || syncInterval < 0 {
+			syncInterval = binlog.SyncNever
+		}
+		binlogFile, restored, err := binlog.Open(*binlogDir, binlog.Config{
+			SyncInterval:   syncInterval,
+			MaxSegmentSize: *binlogSize,
+			Statistics:     stats,
+		})
+		if err != nil {
+			log.Fatalln("Could not open binlog:", err)
+		}
+		defer binlogFile.Close()
+		for _, j := range restored {
+			body, err := binlogFile.ReadBody(j.ID)
+			if err != nil {
+				log.Fatalln("Could not read body of job", j.ID, "from binlog:", err)
+			}
+			j.Body = body
+			if err := restore(j); err != nil {
+				log.Fatalln("Could not restore job", j.ID, "from binlog:", err)
+			}
+		}
+		log.Println("Restored", len(restored), "jobs from binlog.")
+		storageService.Jobs = binlog.NewRegistry(jobs, binlogFile)
+	}
+	if *importDir != "" {
+		// Imported jobs are written to the binlog, if there is one.
+		imported, err := importBeanstalkd(*importDir, restore)
+		if err != nil {
+			log.Fatalln("Could not import beanstalkd binlog:", err)
+		}
+		log.Println("Imported", imported, "jobs from beanstalkd binlog.")
+	}
+	storage := geanstalkd.NewLockService(storageService)
+
+	firstID := geanstalkd.JobID(1)
+	if largest, err := jobs.GetLargestID(); err == nil {
+		firstID = largest + 1
+	} else if err != geanstalkd.ErrEmptyRegistry {
+		log.Fatalln("Could not read largest job ID:", err)
+	}
+	ids := geanstalkd.GenerateIdsFrom(ctx, firstID)
+	ttr := geanstalkd.NewHeapTTRService(storage)
+	defer ttr.Close()
+	delay := geanstalkd.NewPollingDelayService(storage)
+	defer delay.Close()
 	srv := &geanstalkd.Server{
-		Storage: geanstalkd.NewLockService(
-			&geanstalkd.StorageService{
-				Jobs:       inmemory.NewBTreeJobRegistry(btree.New(DefaultBTreeDegree)),
-				ReadyQueue: inmemory.NewJobHeapPriorityQueue(),
-				DelayQueue: inmemory.NewJobHeapPriorityQueue(),
-			},
-		),
-		Ids: ids,
+		Storage:    storage,
+		TTR:        ttr,
+		Delay:      delay,
+		Statistics: stats,
+		MaxJobSize: *maxJobSize,
+		Memory:     memory,
+		Ids:        ids,
+	}
+	drainOnSignal(srv)
+	if *exitWhenDrained {
+		cancelWhenDrained(ctx, cancel, srv)
 	}
+
 	connListener := net.Listener{
 		Server: srv,
 	}
@@ -2,7 +2,9 @@ package geanstalkd
 
 import (
 	"context"
+	"io"
 	"sync"
+	"time"
 )
 
 // LockService handles long-polling and locking to orchestrate
@@ -38,36 +40,291 @@ func (ls *LockService) Add(j *Job) error {
 	return err
 }
 
-// Poll polls a new job. If there is no job available it waits for one to
-// become available, or until the ctx is Done. Error is either an error
-// returned from the storage's PopNextReady() call, or an error returns from
-// context.
-func (ls *LockService) Poll(ctx context.Context) (*Job, error) {
+// Spill moves a large job body out of memory before the job is added. It
+// doesn't take the lock, since it only writes to the storage's BodyStore.
+func (ls *LockService) Spill(j *Job) error {
+	return ls.storage.Spill(j)
+}
+
+// OpenBody returns a reader of the body of a job. The body is opened while
+// holding a read lock, so that a spilled body can't be deleted before it's
+// opened. Returns ErrJobMissing if the job has been deleted.
+func (ls *LockService) OpenBody(j *Job) (io.ReadCloser, error) {
+	ls.lock.RLock()
+	defer ls.lock.RUnlock()
+	return ls.storage.OpenBody(j)
+}
+
+// Watch returns the WatchSet for a list of tubes. It must be released using
+// Unwatch when no longer used.
+func (ls *LockService) Watch(tubes []Tube) *WatchSet {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	return ls.storage.Watch(tubes)
+}
+
+// Unwatch releases a WatchSet previously returned by Watch.
+func (ls *LockService) Unwatch(ws *WatchSet) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	ls.storage.Unwatch(ws)
+}
+
+// Use registers that a client puts jobs in a tube. It must be followed by a
+// call to Unuse when the tube no longer is used.
+func (ls *LockService) Use(tube Tube) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	ls.storage.Use(tube)
+}
+
+// Unuse registers that a client no longer puts jobs in a tube.
+func (ls *LockService) Unuse(tube Tube) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	ls.storage.Unuse(tube)
+}
+
+// Tubes returns the names of all existing tubes.
+func (ls *LockService) Tubes() []Tube {
+	ls.lock.RLock()
+	defer ls.lock.RUnlock()
+	return ls.storage.Tubes()
+}
+
+// TubeStats returns the statistics of a tube. If an error is returned, it has
+// been relayed from the storage.TubeStats() call.
+func (ls *LockService) TubeStats(tube Tube) (TubeStats, error) {
+	ls.lock.RLock()
+	defer ls.lock.RUnlock()
+	return ls.storage.TubeStats(tube)
+}
+
+// Stats returns the server-wide statistics of the storage.
+func (ls *LockService) Stats() StorageStats {
+	ls.lock.RLock()
+	defer ls.lock.RUnlock()
+	return ls.storage.Stats()
+}
+
+// Poll polls a new job from the tubes in a watch set and reserves it for
+// client. If there is no job available it waits
+// for one to become available, or until the ctx is Done. Error is either an
+// error returned from the storage's PopNextReady() call, or an error returns
+// from context. The returned job is a copy that is safe to use without
+// holding any lock.
+func (ls *LockService) Poll(ctx context.Context, client ClientID, ws *WatchSet) (*Job, error) {
 	ls.lock.Lock()
 
 	for {
-		job, err := ls.storage.PopNextReady()
-		if err == nil {
-			return job, nil
-		} else if err != ErrNoJobReady {
+		job, err := ls.storage.PopNextReady(client, ws)
+		if err != ErrNoJobReady {
 			ls.lock.Unlock()
-			return nil, err
+			if err != nil {
+				return nil, err
+			}
+			c := job.Copy()
+			return &c, nil
 		}
 
+		ws.waiting++
 		ok := ls.cond.Wait(ctx)
 		if timeout := !ok; timeout {
+			// Wait does not reacquire the lock on timeout.
+			ls.lock.Lock()
+			ws.waiting--
 			ls.lock.Unlock()
 			return nil, ctx.Err()
 		}
+		ws.waiting--
+	}
+}
+
+// Read returns a copy of the job with the given ID. If an error is returned,
+// it has been relayed from the storage.Read() call.
+func (ls *LockService) Read(id JobID) (*Job, error) {
+	return ls.readCopy(func() (*Job, error) { return ls.storage.Read(id) })
+}
+
+// PeekReady returns a copy of the next ready job in a tube. If an error is
+// returned, it has been relayed from the storage.PeekReady() call.
+func (ls *LockService) PeekReady(tube Tube) (*Job, error) {
+	return ls.readCopy(func() (*Job, error) { return ls.storage.PeekReady(tube) })
+}
+
+// PeekDelayed returns a copy of the next delayed job in a tube. If an error is
+// returned, it has been relayed from the storage.PeekDelayed() call.
+func (ls *LockService) PeekDelayed(tube Tube) (*Job, error) {
+	return ls.readCopy(func() (*Job, error) { return ls.storage.PeekDelayed(tube) })
+}
+
+// PeekBuried returns a copy of the next buried job in a tube. If an error is
+// returned, it has been relayed from the storage.PeekBuried() call.
+func (ls *LockService) PeekBuried(tube Tube) (*Job, error) {
+	return ls.readCopy(func() (*Job, error) { return ls.storage.PeekBuried(tube) })
+}
+
+// readCopy calls read while holding a read lock and returns a copy of the job
+// it returned.
+func (ls *LockService) readCopy(read func() (*Job, error)) (*Job, error) {
+	ls.lock.RLock()
+	defer ls.lock.RUnlock()
+
+	j, err := read()
+	if err != nil {
+		return nil, err
+	}
+	c := j.Copy()
+	return &c, nil
+}
+
+// ReserveByID reserves a job by ID on behalf of client without waiting. The
+// returned job is a copy that is safe to use without holding any lock. If an
+// error is returned, it has been relayed from the storage.ReserveByID() call.
+func (ls *LockService) ReserveByID(client ClientID, id JobID) (*Job, error) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	job, err := ls.storage.ReserveByID(client, id)
+	if err != nil {
+		return nil, err
 	}
+	c := job.Copy()
+	return &c, nil
+}
+
+// DeleteByID deletes a job with the given ID on behalf of client. If an error
+// is returned, it has been relayed from the storage.Delete() call.
+func (ls *LockService) DeleteByID(client ClientID, id JobID) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	return ls.storage.DeleteByID(client, id)
+}
+
+// Release puts a job reserved by client back in the ready or delay queue and
+// notifies other goroutines. If an error is returned, it
+// has been relayed from the storage.Release() call.
+func (ls *LockService) Release(client ClientID, id JobID, pri Priority, delay time.Duration) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	err := ls.storage.Release(client, id, pri, delay)
+	if err == nil {
+		ls.cond.Broadcast()
+	}
+
+	return err
 }
 
-// DeleteByID deletes a job with the given ID. If an error is returned, it has
-// been relayed from the storage.Delete() call.
-func (ls *LockService) DeleteByID(id JobID) error {
+// Bury buries a job reserved by client. If an error is returned, it has been
+// relayed from the storage.Bury() call.
+func (ls *LockService) Bury(client ClientID, id JobID, pri Priority) error {
 	ls.lock.Lock()
 	defer ls.lock.Unlock()
-	return ls.storage.DeleteByID(id)
+	return ls.storage.Bury(client, id, pri)
+}
+
+// Kick moves at most bound buried or delayed jobs in a tube to its ready queue
+// and notifies other goroutines. Returns the number of jobs kicked. If an
+// error is returned, it has been relayed from the storage.Kick() call.
+func (ls *LockService) Kick(tube Tube, bound int) (int, error) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	kicked, err := ls.storage.Kick(tube, bound)
+	if kicked > 0 {
+		ls.cond.Broadcast()
+	}
+
+	return kicked, err
+}
+
+// KickJob moves a buried or delayed job to the ready queue and notifies other
+// goroutines. If an error is returned, it has been relayed from the
+// storage.KickJob() call.
+func (ls *LockService) KickJob(id JobID) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	err := ls.storage.KickJob(id)
+	if err == nil {
+		ls.cond.Broadcast()
+	}
+
+	return err
+}
+
+// PromoteDelayed moves all delayed jobs that are runnable at now to the ready
+// queue and resumes all paused tubes whose pause has ended. Notifies other
+// goroutines if any job was moved or tube resumed. Returns when the next
+// delayed job becomes runnable or paused tube is resumed, or nil if there is
+// neither. If an error is returned, it has been relayed from the storage.
+func (ls *LockService) PromoteDelayed(now time.Time) (*time.Time, error) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	moved, err := ls.storage.PromoteDelayed(now)
+	resumed, resumeErr := ls.storage.ResumePaused(now)
+	if moved > 0 || resumed > 0 {
+		ls.cond.Broadcast()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resumeErr != nil {
+		return nil, resumeErr
+	}
+
+	var at *time.Time
+	next, err := ls.storage.PeekNextDelayed()
+	if err == nil {
+		runnableAt := *next.RunnableAt
+		at = &runnableAt
+	} else if err != ErrNoJobDelayed {
+		return nil, err
+	}
+	if resume, ok := ls.storage.NextResume(); ok && (at == nil || resume.Before(*at)) {
+		at = &resume
+	}
+	return at, nil
+}
+
+// PauseTube keeps jobs in a tube from being reserved for a duration. If an
+// error is returned, it has been relayed from the storage.PauseTube() call.
+func (ls *LockService) PauseTube(tube Tube, pause time.Duration) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	return ls.storage.PauseTube(tube, pause)
+}
+
+// Requeue puts a timed out job back in the ready queue and notifies other
+// goroutines that there is a new job available. If an error is returned, it
+// has been relayed from the storage.Requeue() call.
+func (ls *LockService) Requeue(client ClientID, id JobID, reserves uint64) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	err := ls.storage.Requeue(client, id, reserves)
+	if err == nil {
+		ls.cond.Broadcast()
+	}
+
+	return err
+}
+
+// Unreserve puts a job reserved by client back in the ready queue and
+// notifies other goroutines. If an error is returned, it has been relayed
+// from the storage.Unreserve() call.
+func (ls *LockService) Unreserve(client ClientID, id JobID) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	err := ls.storage.Unreserve(client, id)
+	if err == nil {
+		ls.cond.Broadcast()
+	}
+
+	return err
 }
 
 // channelCond is very similar to `sync.Cond`, but supports timeouts while waiting.
@@ -75,28 +332,29 @@ type channelCond struct {
 	outerLock sync.Locker
 
 	lock     sync.RWMutex
-	channels []chan struct{}
+	nextID   channelCondID
+	channels map[channelCondID]chan struct{}
 }
 
 func newChannelCond(l sync.Locker) *channelCond {
 	return &channelCond{
 		outerLock: l,
+		channels:  make(map[channelCondID]chan struct{}),
 	}
 }
 
 type channelCondID int
 
 func (cc *channelCond) register() channelCondID {
-	cc.channels = append(cc.channels, make(chan struct{}, 1))
-	return channelCondID(len(cc.channels) - 1)
+	id := cc.nextID
+	cc.nextID++
+	cc.channels[id] = make(chan struct{}, 1)
+	return id
 }
 
 func (cc *channelCond) unregister(id channelCondID) {
-	c := cc.channels[id]
-	close(c)
-
-	// Delete index `id`. See https://github.com/golang/go/wiki/SliceTricks.
-	cc.channels = append(cc.channels[:id], cc.channels[id+1:]...)
+	close(cc.channels[id])
+	delete(cc.channels, id)
 }
 
 // Wait waits for a conditional or timeout to happen. If a conditional event is
@@ -105,8 +363,6 @@ func (cc *channelCond) Wait(ctx context.Context) bool {
 	cc.lock.Lock()
 	id := cc.register()
 
-	// Channel could move around in the array while we are `Wait`ing, so
-	// important to extract it before running `select` below.
 	c := cc.channels[id]
 
 	cc.lock.Unlock()
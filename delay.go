@@ -0,0 +1,108 @@
+package geanstalkd
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// PollingDelayService is a DelayService which sleeps until the next delayed
+// job in the LockService becomes runnable and then moves it to the ready
+// queue. It keeps no state of its own apart from when to wake up next. Use
+// NewPollingDelayService to create one.
+type PollingDelayService struct {
+	storage *LockService
+
+	// lock is held while promoting jobs, so that Schedule can't miss a
+	// wakeup.
+	lock sync.Mutex
+	next *time.Time
+
+	wakeup chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewPollingDelayService creates a new PollingDelayService and starts its
+// background goroutine. Call Close to stop it.
+func NewPollingDelayService(storage *LockService) *PollingDelayService {
+	d := &PollingDelayService{
+		storage: storage,
+		wakeup:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	d.wg.Add(1)
+	go d.run()
+
+	return d
+}
+
+// Schedule notifies the service that a delayed job becomes runnable at the
+// given time. The service wakes up earlier than planned if needed.
+func (d *PollingDelayService) Schedule(at time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.next != nil && !at.Before(*d.next) {
+		return
+	}
+	d.next = &at
+
+	select {
+	case d.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the background goroutine. Delayed jobs are no longer promoted
+// after Close has returned.
+func (d *PollingDelayService) Close() error {
+	close(d.done)
+	d.wg.Wait()
+	return nil
+}
+
+func (d *PollingDelayService) promote() *time.Time {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	next, err := d.storage.PromoteDelayed(time.Now())
+	if err != nil {
+		// Retrying on next Schedule.
+		log.Println("Could not promote delayed jobs:", err)
+	}
+	d.next = next
+
+	return next
+}
+
+func (d *PollingDelayService) run() {
+	defer d.wg.Done()
+
+	for {
+		next := d.promote()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if next != nil {
+			timer = time.NewTimer(time.Until(*next))
+			timeout = timer.C
+		}
+
+		stopped := false
+		select {
+		case <-timeout:
+		case <-d.wakeup:
+		case <-d.done:
+			stopped = true
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if stopped {
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package geanstalkd_test
+
+import (
+	"context"
+	"time"
+
+	. "testing"
+)
+
+func TestDelayedJobBecomesReady(t *T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newTestServer(ctx)
+	defer closeTestServer(srv)
+
+	job := addTestJob(t, srv, time.Second, time.Minute)
+
+	noWaitCtx, noWaitCancel := context.WithTimeout(ctx, 0)
+	defer noWaitCancel()
+	if _, err := srv.Reserve(noWaitCtx, 1, srv.Watch(defaultTubes)); err != context.DeadlineExceeded {
+		t.Fatal("Expected delayed job not to be ready. Got:", err)
+	}
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer timeoutCancel()
+	reserved, err := srv.Reserve(timeoutCtx, 1, srv.Watch(defaultTubes))
+	if err != nil {
+		t.Fatal("Expected the delayed job to become ready. Error:", err)
+	}
+	if reserved.ID != job.ID {
+		t.Errorf("Unexpected job reserved. Reserved: %d Expected: %d", reserved.ID, job.ID)
+	}
+}
+
+func TestEarlierDelayedJobReschedules(t *T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newTestServer(ctx)
+	defer closeTestServer(srv)
+
+	addTestJob(t, srv, time.Hour, time.Minute)
+	earlierJob := addTestJob(t, srv, time.Second, time.Minute)
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer timeoutCancel()
+	reserved, err := srv.Reserve(timeoutCtx, 1, srv.Watch(defaultTubes))
+	if err != nil {
+		t.Fatal("Expected the earlier delayed job to become ready. Error:", err)
+	}
+	if reserved.ID != earlierJob.ID {
+		t.Errorf("Unexpected job reserved. Reserved: %d Expected: %d", reserved.ID, earlierJob.ID)
+	}
+}
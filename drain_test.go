@@ -0,0 +1,56 @@
+package geanstalkd_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/JensRantil/geanstalkd"
+
+	. "testing"
+)
+
+func TestDrainingServerRejectsNewJobs(t *T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newTestServer(ctx)
+	defer closeTestServer(srv)
+
+	srv.SetDraining(true)
+	job := srv.BuildJob(geanstalkd.DefaultTube, 0, 0, time.Second, []byte("hello"))
+	if err := srv.Add(&job); err != geanstalkd.ErrDraining {
+		t.Error("Expected ErrDraining. Got:", err)
+	}
+}
+
+func TestWaitDrained(t *T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newTestServer(ctx)
+	defer closeTestServer(srv)
+
+	job := addTestJob(t, srv, 0, time.Minute)
+	srv.SetDraining(true)
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer timeoutCancel()
+	if err := srv.WaitDrained(timeoutCtx); err != context.DeadlineExceeded {
+		t.Fatal("Expected the server not to be drained while holding a job. Got:", err)
+	}
+
+	if _, err := srv.Reserve(ctx, 1, srv.Watch(defaultTubes)); err != nil {
+		t.Fatal("Could not reserve job while draining:", err)
+	}
+	if err := srv.DeleteByID(1, job.ID); err != nil {
+		t.Fatal("Could not delete job while draining:", err)
+	}
+
+	timeoutCtx, timeoutCancel = context.WithTimeout(ctx, 3*time.Second)
+	defer timeoutCancel()
+	if err := srv.WaitDrained(timeoutCtx); err != nil {
+		t.Error("Expected the server to be drained. Got:", err)
+	}
+}
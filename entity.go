@@ -13,16 +13,97 @@ type JobID uint64
 // values.
 type Priority uint64
 
+// ClientID identifies a connected client. It is used to keep track of which
+// client has reserved a job.
+type ClientID uint64
+
 // Tube is a queue.
 type Tube string
 
+// JobState is the state of a job. Which transitions between states are legal
+// is defined by CanTransitionTo.
+type JobState int
+
+// All states a job can be in.
+const (
+	StateReady JobState = iota
+	StateDelayed
+	StateReserved
+	StateBuried
+)
+
+var jobStateNames = map[JobState]string{
+	StateReady:    "ready",
+	StateDelayed:  "delayed",
+	StateReserved: "reserved",
+	StateBuried:   "buried",
+}
+
+// String returns the name of the state as it is presented in the beanstalkd
+// protocol.
+func (s JobState) String() string {
+	if name, ok := jobStateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+var legalTransitions = map[JobState][]JobState{
+	StateReady:    {StateReserved},
+	StateDelayed:  {StateReady, StateReserved},
+	StateReserved: {StateReady, StateDelayed, StateBuried},
+	StateBuried:   {StateReady, StateReserved},
+}
+
+// CanTransitionTo returns whether a job in state s can be moved to state to.
+func (s JobState) CanTransitionTo(to JobState) bool {
+	for _, legal := range legalTransitions[s] {
+		if legal == to {
+			return true
+		}
+	}
+	return false
+}
+
 // Job is the structure containing all the metadata for a job.
 type Job struct {
-	ID         JobID
+	ID    JobID
+	Tube  Tube
+	State JobState
+	// ReservedBy is the client that has reserved the job. Only meaningful in
+	// StateReserved.
+	ReservedBy ClientID
 	RunnableAt *time.Time
 	TimeToRun  time.Duration
 	Body       []byte
-	Priority   Priority
+	// BodyRef refers to the body in a BodyStore if it has been spilled out of
+	// memory, in which case Body is nil.
+	BodyRef  *BodyRef
+	Priority Priority
+
+	// CreatedAt is when the job was put.
+	CreatedAt time.Time
+	// Delay is the delay the job was last put or released with.
+	Delay time.Duration
+	Stats JobStats
+}
+
+// JobStats counts the events in the life of a job.
+type JobStats struct {
+	Reserves uint64
+	Timeouts uint64
+	Releases uint64
+	Buries   uint64
+	Kicks    uint64
+}
+
+// BodySize returns the size of the job's body, whether it's in memory or
+// spilled to a BodyStore.
+func (j Job) BodySize() int {
+	if j.BodyRef != nil {
+		return j.BodyRef.Size
+	}
+	return len(j.Body)
 }
 
 // Copy creates a new copy of the job.
@@ -1,6 +1,9 @@
 package geanstalkd
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 // TODO: Split these up into separate variable groups.
 var (
@@ -11,3 +14,15 @@ var (
 	ErrEmptyQueue        = errors.New("queue is empty")
 	ErrQueueAlreadyExist = errors.New("queue already exists")
 )
+
+// TransitionError is returned when a job is asked to make an illegal state
+// transition.
+type TransitionError struct {
+	ID   JobID
+	From JobState
+	To   JobState
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("job %d can't go from %s to %s", e.ID, e.From, e.To)
+}
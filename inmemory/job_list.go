@@ -0,0 +1,80 @@
+package inmemory
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// JobListQueue is an in-memory geanstalkd.JobQueue implementation backed by a
+// linked list. Use NewJobListQueue to create one.
+type JobListQueue struct {
+	list        *list.List
+	elementByID map[geanstalkd.JobID]*list.Element
+	lock        sync.RWMutex
+}
+
+// NewJobListQueue returns a new JobListQueue ready for immediate use.
+func NewJobListQueue() *JobListQueue {
+	return &JobListQueue{
+		list:        list.New(),
+		elementByID: make(map[geanstalkd.JobID]*list.Element),
+	}
+}
+
+// Push adds a new job to the back of the queue. If a job with the given ID
+// already has been pushed, geanstalkd.ErrJobAlreadyExist is returned.
+func (q *JobListQueue) Push(j *geanstalkd.Job) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, exists := q.elementByID[j.ID]; exists {
+		return geanstalkd.ErrJobAlreadyExist
+	}
+	q.elementByID[j.ID] = q.list.PushBack(j)
+	return nil
+}
+
+// Pop removes and returns the job at the front of the queue.
+// geanstalkd.ErrEmptyQueue is returned if the queue is empty.
+func (q *JobListQueue) Pop() (*geanstalkd.Job, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	front := q.list.Front()
+	if front == nil {
+		return nil, geanstalkd.ErrEmptyQueue
+	}
+	job := q.list.Remove(front).(*geanstalkd.Job)
+	delete(q.elementByID, job.ID)
+	return job, nil
+}
+
+// Peek returns the job which would be returned if Pop() is called.
+// geanstalkd.ErrEmptyQueue is returned if the queue is empty.
+func (q *JobListQueue) Peek() (*geanstalkd.Job, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	front := q.list.Front()
+	if front == nil {
+		return nil, geanstalkd.ErrEmptyQueue
+	}
+	return front.Value.(*geanstalkd.Job), nil
+}
+
+// RemoveByID removes a job with given ID previously pushed to this queue.
+// geanstalkd.ErrJobMissing if a job with the given ID could not be found.
+func (q *JobListQueue) RemoveByID(id geanstalkd.JobID) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	element, ok := q.elementByID[id]
+	if !ok {
+		return geanstalkd.ErrJobMissing
+	}
+	q.list.Remove(element)
+	delete(q.elementByID, id)
+	return nil
+}
@@ -0,0 +1,18 @@
+package inmemory
+
+import (
+	. "testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/JensRantil/geanstalkd/testing"
+)
+
+func TestJobListQueue(t *T) {
+	t.Parallel()
+
+	Convey("Given a fresh JobListQueue", t, func() {
+		jq := NewJobListQueue()
+		testing.GenericJobQueueTest(jq)
+	})
+}
@@ -0,0 +1,105 @@
+package inmemory
+
+import (
+	"fmt"
+	. "testing"
+
+	"github.com/google/btree"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/JensRantil/geanstalkd"
+	"github.com/JensRantil/geanstalkd/testing"
+)
+
+func TestStorageService(t *T) {
+	t.Parallel()
+
+	Convey("Given a StorageService backed by in-memory structures", t, func() {
+		testing.GenericStorageServiceTest(newStorageService())
+	})
+}
+
+func newStorageService() *geanstalkd.StorageService {
+	return &geanstalkd.StorageService{
+		Jobs:                 NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize)),
+		DelayTubes:           NewTubeHeapPriorityQueue(),
+		NewJobPriorityQueue:  func() geanstalkd.JobPriorityQueue { return NewJobHeapPriorityQueue() },
+		NewJobQueue:          func() geanstalkd.JobQueue { return NewJobListQueue() },
+		NewTubePriorityQueue: func() geanstalkd.TubePriorityQueue { return NewTubeHeapPriorityQueue() },
+	}
+}
+
+func benchmarkTubeName(i int) geanstalkd.Tube {
+	return geanstalkd.Tube(fmt.Sprintf("tube-%d", i))
+}
+
+// benchmarkReserve reserves and releases jobs from watched tubes out of
+// totalTubes tubes that all contain jobs.
+func benchmarkReserve(b *B, totalTubes, watchedTubes int) {
+	s := newStorageService()
+
+	var watched []geanstalkd.Tube
+	for i := 0; i < totalTubes; i++ {
+		tube := benchmarkTubeName(i)
+		if i < watchedTubes {
+			watched = append(watched, tube)
+		}
+		for k := 0; k < 10; k++ {
+			job := &geanstalkd.Job{
+				ID:       geanstalkd.JobID(i*10 + k + 1),
+				Tube:     tube,
+				Priority: geanstalkd.Priority(k),
+			}
+			if err := s.Add(job); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	ws := s.Watch(watched)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		job, err := s.PopNextReady(1, ws)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := s.Release(1, job.ID, job.Priority+1, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReserve(b *B) {
+	for _, c := range []struct{ total, watched int }{
+		{1, 1},
+		{1000, 50},
+		{1000, 1000},
+		{10000, 50},
+		{10000, 10000},
+	} {
+		b.Run(fmt.Sprintf("%d/%d tubes watched", c.watched, c.total), func(b *B) {
+			benchmarkReserve(b, c.total, c.watched)
+		})
+	}
+}
+
+// BenchmarkPutWithWatchSets measures adding jobs to a tube which is part of
+// many distinct watch sets.
+func BenchmarkPutWithWatchSets(b *B) {
+	for _, watchSets := range []int{1, 100, 1000} {
+		b.Run(fmt.Sprintf("%d watch sets", watchSets), func(b *B) {
+			s := newStorageService()
+			for i := 0; i < watchSets; i++ {
+				s.Watch([]geanstalkd.Tube{geanstalkd.DefaultTube, benchmarkTubeName(i)})
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				job := &geanstalkd.Job{ID: geanstalkd.JobID(i + 1), Tube: geanstalkd.DefaultTube}
+				if err := s.Add(job); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
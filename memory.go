@@ -0,0 +1,58 @@
+package geanstalkd
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// DefaultMaxJobSize is the largest job body accepted unless configured
+// otherwise.
+const DefaultMaxJobSize = 65535
+
+// ErrOutOfMemory is returned when a MemoryBudget has no room left.
+var ErrOutOfMemory = errors.New("out of memory for job bodies")
+
+// MemoryBudget limits the total size of the job bodies kept in memory. A nil
+// MemoryBudget has no limit. Use NewMemoryBudget to create one.
+type MemoryBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// NewMemoryBudget returns a MemoryBudget of limit bytes.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// Reserve uses n bytes of the budget. Returns ErrOutOfMemory, and uses
+// nothing, if they don't fit. Reserved bytes are freed using Add(-n).
+func (b *MemoryBudget) Reserve(n int64) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		used := b.used.Load()
+		if used+n > b.limit {
+			return ErrOutOfMemory
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			return nil
+		}
+	}
+}
+
+// Add uses n bytes regardless of the limit, or frees them if n is negative.
+// It is used for jobs which must be kept, such as those restored at startup.
+func (b *MemoryBudget) Add(n int64) {
+	if b != nil {
+		b.used.Add(n)
+	}
+}
+
+// Used returns the number of bytes used.
+func (b *MemoryBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.used.Load()
+}
@@ -0,0 +1,66 @@
+package geanstalkd_test
+
+import (
+	"github.com/google/btree"
+
+	"github.com/JensRantil/geanstalkd"
+	"github.com/JensRantil/geanstalkd/inmemory"
+
+	. "testing"
+)
+
+func TestMemoryBudget(t *T) {
+	t.Parallel()
+
+	b := geanstalkd.NewMemoryBudget(10)
+	if err := b.Reserve(8); err != nil {
+		t.Fatal("Could not reserve memory:", err)
+	}
+	if err := b.Reserve(3); err != geanstalkd.ErrOutOfMemory {
+		t.Fatal("Expected ErrOutOfMemory. Got:", err)
+	}
+	b.Add(5)
+	if used := b.Used(); used != 13 {
+		t.Fatal("Expected 13 bytes to be used. Got:", used)
+	}
+	b.Add(-13)
+	if err := b.Reserve(10); err != nil {
+		t.Fatal("Could not reserve memory:", err)
+	}
+
+	var unlimited *geanstalkd.MemoryBudget
+	if err := unlimited.Reserve(1 << 40); err != nil {
+		t.Error("Expected a nil budget to have no limit. Got:", err)
+	}
+}
+
+func TestStorageServiceAccountsMemory(t *T) {
+	t.Parallel()
+
+	memory := geanstalkd.NewMemoryBudget(100)
+	s := &geanstalkd.StorageService{
+		Jobs:                 inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize)),
+		DelayTubes:           inmemory.NewTubeHeapPriorityQueue(),
+		NewJobPriorityQueue:  func() geanstalkd.JobPriorityQueue { return inmemory.NewJobHeapPriorityQueue() },
+		NewJobQueue:          func() geanstalkd.JobQueue { return inmemory.NewJobListQueue() },
+		NewTubePriorityQueue: func() geanstalkd.TubePriorityQueue { return inmemory.NewTubeHeapPriorityQueue() },
+		Memory:               memory,
+	}
+
+	if err := s.Add(&geanstalkd.Job{ID: 1, Tube: "a", Body: []byte("hello")}); err != nil {
+		t.Fatal("Could not add job:", err)
+	}
+	if err := s.Restore(&geanstalkd.Job{ID: 2, Tube: "a", State: geanstalkd.StateBuried, Body: []byte("hi")}); err != nil {
+		t.Fatal("Could not restore job:", err)
+	}
+	if used := memory.Used(); used != 7 {
+		t.Fatal("Expected the bodies to use 7 bytes. Got:", used)
+	}
+
+	if err := s.DeleteByID(0, 1); err != nil {
+		t.Fatal("Could not delete job:", err)
+	}
+	if used := memory.Used(); used != 2 {
+		t.Error("Expected the deleted body to be freed. Used:", used)
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"context"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/textproto"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/JensRantil/geanstalkd"
@@ -24,6 +26,8 @@ const maxLineLength = 1024
 type Listener struct {
 	// TODO: Rename to something else. It doesn't just listen.
 	Server *geanstalkd.Server
+
+	lastClientID uint64
 }
 
 // Serve is the network loop that accepts incoming connections and handles
@@ -39,13 +43,15 @@ func (tl *Listener) Serve(ctx context.Context, l net.Listener) {
 				return
 			}
 			// Handle connections in a new goroutine.
+			wg.Add(1)
 			go func() {
-				wg.Add(1)
 				defer wg.Done()
 
 				childCtx, cancel := context.WithCancel(ctx)
 				ch := connectionHandler{
 					tl.Server,
+					geanstalkd.ClientID(atomic.AddUint64(&tl.lastClientID, 1)),
+					newConnectionState(),
 					childCtx,
 					cancel,
 					textproto.NewConn(conn),
@@ -65,8 +71,87 @@ func (tl *Listener) Serve(ctx context.Context, l net.Listener) {
 
 }
 
+// connectionState is the protocol state of a single connection. Requests on a
+// connection are handled one at a time, so it needs no locking.
+type connectionState struct {
+	// Used is the tube that new jobs are put in.
+	Used geanstalkd.Tube
+	// Watched are the tubes that jobs are reserved from, in the order they
+	// were watched. Never empty.
+	Watched []geanstalkd.Tube
+	// WatchSet is the geanstalkd.WatchSet for Watched.
+	WatchSet *geanstalkd.WatchSet
+
+	// Producer is whether the connection has put a job.
+	Producer bool
+	// Worker is whether the connection has reserved a job.
+	Worker bool
+}
+
+func newConnectionState() *connectionState {
+	return &connectionState{
+		Used:    geanstalkd.DefaultTube,
+		Watched: []geanstalkd.Tube{geanstalkd.DefaultTube},
+	}
+}
+
+// watch adds a tube to the watch list unless it is already watched. Returns
+// whether the watch list changed.
+func (cs *connectionState) watch(tube geanstalkd.Tube) bool {
+	for _, watched := range cs.Watched {
+		if watched == tube {
+			return false
+		}
+	}
+	cs.Watched = append(cs.Watched, tube)
+	return true
+}
+
+// ignore removes a tube from the watch list. Returns whether the watch list
+// changed and false for ok if the tube is the only tube watched, in which
+// case it isn't removed.
+func (cs *connectionState) ignore(tube geanstalkd.Tube) (changed, ok bool) {
+	for i, watched := range cs.Watched {
+		if watched == tube {
+			if len(cs.Watched) == 1 {
+				return false, false
+			}
+			cs.Watched = append(cs.Watched[:i:i], cs.Watched[i+1:]...)
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// markProducer records that the connection has put a job.
+func (ch connectionHandler) markProducer() {
+	if !ch.State.Producer {
+		ch.State.Producer = true
+		ch.Server.Statistics.Add(geanstalkd.CounterCurrentProducers, 1)
+	}
+}
+
+// markWorker records that the connection has reserved a job.
+func (ch connectionHandler) markWorker() {
+	if !ch.State.Worker {
+		ch.State.Worker = true
+		ch.Server.Statistics.Add(geanstalkd.CounterCurrentWorkers, 1)
+	}
+}
+
+// rewatch replaces the connection's WatchSet after Watched has changed.
+func (ch connectionHandler) rewatch() {
+	old := ch.State.WatchSet
+	ch.State.WatchSet = ch.Server.Watch(ch.State.Watched)
+	if old != nil {
+		ch.Server.Unwatch(old)
+	}
+}
+
 type connectionHandler struct {
 	Server *geanstalkd.Server
+	Client geanstalkd.ClientID
+	State  *connectionState
 
 	Ctx             context.Context
 	CloseConnection context.CancelFunc
@@ -77,6 +162,26 @@ type connectionHandler struct {
 func (ch connectionHandler) Handle() {
 	defer ch.CloseConnection()
 
+	ch.Server.Statistics.Add(geanstalkd.CounterCurrentConnections, 1)
+	ch.Server.Statistics.Add(geanstalkd.CounterTotalConnections, 1)
+	ch.Server.Use(ch.State.Used)
+	ch.rewatch()
+	defer func() {
+		if err := ch.Server.ReleaseAll(ch.Client); err != nil {
+			log.Println("Could not release reserved jobs:", err)
+		}
+		ch.Server.Unuse(ch.State.Used)
+		ch.Server.Unwatch(ch.State.WatchSet)
+
+		ch.Server.Statistics.Add(geanstalkd.CounterCurrentConnections, -1)
+		if ch.State.Producer {
+			ch.Server.Statistics.Add(geanstalkd.CounterCurrentProducers, -1)
+		}
+		if ch.State.Worker {
+			ch.Server.Statistics.Add(geanstalkd.CounterCurrentWorkers, -1)
+		}
+	}()
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
@@ -132,7 +237,6 @@ func (ch connectionHandler) handleSingleRequest() {
 		cmdAndArgs := strings.Split(commandLine, " ")
 
 		var handler cmdHandler
-		handler = unknownCommandHandler
 		var cmdArgs []string
 
 		if len(cmdAndArgs) > 0 {
@@ -145,9 +249,63 @@ func (ch connectionHandler) handleSingleRequest() {
 				handler = putHandler
 			case "delete":
 				handler = deleteHandler
+			case "reserve":
+				handler = reserveHandler
+			case "reserve-with-timeout":
+				handler = reserveWithTimeoutHandler
+			case "reserve-job":
+				handler = reserveJobHandler
+			case "release":
+				handler = releaseHandler
+			case "touch":
+				handler = touchHandler
+			case "bury":
+				handler = buryHandler
+			case "kick":
+				handler = kickHandler
+			case "kick-job":
+				handler = kickJobHandler
+			case "peek":
+				handler = peekHandler
+			case "peek-ready":
+				handler = peekReadyHandler
+			case "peek-delayed":
+				handler = peekDelayedHandler
+			case "peek-buried":
+				handler = peekBuriedHandler
+			case "stats":
+				handler = statsHandler
+			case "stats-job":
+				handler = statsJobHandler
+			case "stats-tube":
+				handler = statsTubeHandler
+			case "list-tubes":
+				handler = listTubesHandler
+			case "list-tube-used":
+				handler = listTubeUsedHandler
+			case "list-tubes-watched":
+				handler = listTubesWatchedHandler
+			case "pause-tube":
+				handler = pauseTubeHandler
+			case "drain":
+				handler = drainHandler
+			case "undrain":
+				handler = undrainHandler
+			case "use":
+				handler = useHandler
+			case "watch":
+				handler = watchHandler
+			case "ignore":
+				handler = ignoreHandler
 			}
 		}
 
+		if handler != nil {
+			ch.Server.Statistics.Add(geanstalkd.CommandCounter(cmdAndArgs[0]), 1)
+		} else {
+			handler = unknownCommandHandler
+		}
+
 		handler(ch, id, cmdArgs)
 		ch.Conn.Pipeline.EndResponse(id)
 	}()
@@ -166,7 +324,7 @@ type integerParser struct {
 
 func (i *integerParser) Parse(s string) uint64 {
 	result, err := strconv.ParseUint(s, 10, 64)
-	if i.Err != nil {
+	if i.Err == nil {
 		i.Err = err
 	}
 	return result
@@ -185,13 +343,35 @@ func putHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
 	delay := p.Parse(cmdArgs[1])
 	ttr := p.Parse(cmdArgs[2])
 	nbytes := p.Parse(cmdArgs[3])
-	if p.Err != nil {
+	if p.Err != nil || delay > math.MaxUint32 || ttr > math.MaxUint32 {
 		ch.Conn.Pipeline.EndRequest(pipelineID)
 		ch.Conn.Pipeline.StartResponse(pipelineID)
 		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
 		return
 	}
 
+	// Reject the job before allocating its body.
+	var rejection string
+	if nbytes > uint64(ch.Server.JobSizeLimit()) {
+		rejection = "JOB_TOO_BIG"
+	} else if err := ch.Server.Memory.Reserve(int64(nbytes)); err != nil {
+		rejection = "OUT_OF_MEMORY"
+	} else {
+		// The StorageService accounts for the body once it's stored.
+		defer ch.Server.Memory.Add(-int64(nbytes))
+	}
+	if rejection != "" {
+		err := discardBody(ch.Conn.Reader.R, nbytes)
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		if err != nil {
+			ch.CloseConnection()
+			return
+		}
+		ch.Conn.Writer.PrintfLine("%s", rejection)
+		return
+	}
+
 	// Read up job data
 
 	jobdata := make([]byte, nbytes)
@@ -211,26 +391,40 @@ func putHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
 
 	ch.Conn.Pipeline.EndRequest(pipelineID)
 
+	ch.markProducer()
 	job := ch.Server.BuildJob(
+		ch.State.Used,
 		geanstalkd.Priority(pri),
-		time.Now().Add(time.Duration(delay)*time.Second),
+		time.Duration(delay)*time.Second,
 		time.Duration(ttr)*time.Second,
 		jobdata,
 	)
 	if err := ch.Server.Add(&job); err != nil {
 		if err == geanstalkd.ErrDraining {
-			ch.Conn.Pipeline.EndRequest(pipelineID)
 			ch.Conn.Pipeline.StartResponse(pipelineID)
 			ch.Conn.Writer.PrintfLine("DRAINING")
 			return
 		}
-		log.Fatalln(err)
+		log.Println("Could not add job:", err)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("INTERNAL_ERROR")
+		return
 	}
 
 	ch.Conn.Pipeline.StartResponse(pipelineID)
 	ch.Conn.Writer.PrintfLine("INSERTED %d", job.ID)
 }
 
+// discardBody skips a job body of n bytes and its trailing CRLF without
+// keeping them in memory.
+func discardBody(r io.Reader, n uint64) error {
+	if n > math.MaxInt64-2 {
+		n = math.MaxInt64 - 2
+	}
+	_, err := io.CopyN(io.Discard, r, int64(n)+2)
+	return err
+}
+
 func deleteHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
 	if len(cmdArgs) != 1 {
 		ch.Conn.Pipeline.EndRequest(pipelineID)
@@ -250,7 +444,7 @@ func deleteHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
 
 	ch.Conn.Pipeline.EndRequest(pipelineID)
 
-	err := ch.Server.DeleteByID(geanstalkd.JobID(id))
+	err := ch.Server.DeleteByID(ch.Client, geanstalkd.JobID(id))
 
 	ch.Conn.Pipeline.StartResponse(pipelineID)
 
@@ -262,6 +456,512 @@ func deleteHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
 	ch.Conn.Writer.PrintfLine("DELETED")
 }
 
+func releaseHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	if len(cmdArgs) != 3 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	p := new(integerParser)
+	id := p.Parse(cmdArgs[0])
+	pri := p.Parse(cmdArgs[1])
+	delay := p.Parse(cmdArgs[2])
+	if p.Err != nil || delay > math.MaxUint32 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	err := ch.Server.Release(
+		ch.Client,
+		geanstalkd.JobID(id),
+		geanstalkd.Priority(pri),
+		time.Duration(delay)*time.Second,
+	)
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if err != nil {
+		ch.Conn.Writer.PrintfLine("NOT_FOUND")
+		return
+	}
+
+	ch.Conn.Writer.PrintfLine("RELEASED")
+}
+
+func touchHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	if len(cmdArgs) != 1 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	p := new(integerParser)
+	id := p.Parse(cmdArgs[0])
+	if p.Err != nil {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	err := ch.Server.Touch(ch.Client, geanstalkd.JobID(id))
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if err != nil {
+		ch.Conn.Writer.PrintfLine("NOT_FOUND")
+		return
+	}
+
+	ch.Conn.Writer.PrintfLine("TOUCHED")
+}
+
+func buryHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	if len(cmdArgs) != 2 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	p := new(integerParser)
+	id := p.Parse(cmdArgs[0])
+	pri := p.Parse(cmdArgs[1])
+	if p.Err != nil {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	err := ch.Server.Bury(ch.Client, geanstalkd.JobID(id), geanstalkd.Priority(pri))
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if err != nil {
+		ch.Conn.Writer.PrintfLine("NOT_FOUND")
+		return
+	}
+
+	ch.Conn.Writer.PrintfLine("BURIED")
+}
+
+func kickHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	if len(cmdArgs) != 1 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	p := new(integerParser)
+	bound := p.Parse(cmdArgs[0])
+	if p.Err != nil || bound > math.MaxInt32 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	kicked, err := ch.Server.Kick(ch.State.Used, int(bound))
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+	if err != nil {
+		log.Println("Could not kick jobs:", err)
+		ch.Conn.Writer.PrintfLine("INTERNAL_ERROR")
+		return
+	}
+	ch.Conn.Writer.PrintfLine("KICKED %d", kicked)
+}
+
+func kickJobHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	if len(cmdArgs) != 1 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	p := new(integerParser)
+	id := p.Parse(cmdArgs[0])
+	if p.Err != nil {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	err := ch.Server.KickJob(geanstalkd.JobID(id))
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if err != nil {
+		ch.Conn.Writer.PrintfLine("NOT_FOUND")
+		return
+	}
+
+	ch.Conn.Writer.PrintfLine("KICKED")
+}
+
+func reserveHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	if len(cmdArgs) != 0 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	reserve(ch.Ctx, ch, pipelineID)
+}
+
+func reserveWithTimeoutHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	if len(cmdArgs) != 1 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	p := new(integerParser)
+	timeout := p.Parse(cmdArgs[0])
+	if p.Err != nil || timeout > math.MaxUint32 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	ctx, cancel := context.WithTimeout(ch.Ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	reserve(ctx, ch, pipelineID)
+}
+
+func reserveJobHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	if len(cmdArgs) != 1 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	p := new(integerParser)
+	id := p.Parse(cmdArgs[0])
+	if p.Err != nil {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	ch.markWorker()
+	job, err := ch.Server.ReserveJob(ch.Client, geanstalkd.JobID(id))
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if err != nil {
+		ch.Conn.Writer.PrintfLine("NOT_FOUND")
+		return
+	}
+
+	writeReserved(ch, job)
+}
+
+// reserve blocks until a job has been reserved or ctx is done and writes the
+// response. Must be called after the request has been ended.
+func reserve(ctx context.Context, ch connectionHandler, pipelineID uint) {
+	ch.markWorker()
+	job, err := ch.Server.Reserve(ctx, ch.Client, ch.State.WatchSet)
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	switch err {
+	case nil:
+		writeReserved(ch, job)
+	case geanstalkd.ErrDeadlineSoon:
+		ch.Conn.Writer.PrintfLine("DEADLINE_SOON")
+	case context.DeadlineExceeded:
+		ch.Conn.Writer.PrintfLine("TIMED_OUT")
+	case context.Canceled:
+		// The connection is being closed. Nobody to respond to.
+	default:
+		log.Println("Could not reserve job:", err)
+		ch.Conn.Writer.PrintfLine("INTERNAL_ERROR")
+	}
+}
+
+func peekHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	if len(cmdArgs) != 1 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	p := new(integerParser)
+	id := p.Parse(cmdArgs[0])
+	if p.Err != nil {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	job, err := ch.Server.Peek(geanstalkd.JobID(id))
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+	writePeekResponse(ch, job, err)
+}
+
+func peekReadyHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	peekTube(ch, pipelineID, cmdArgs, ch.Server.PeekReady)
+}
+
+func peekDelayedHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	peekTube(ch, pipelineID, cmdArgs, ch.Server.PeekDelayed)
+}
+
+func peekBuriedHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	peekTube(ch, pipelineID, cmdArgs, ch.Server.PeekBuried)
+}
+
+// peekTube handles the peek commands which look at a queue of the used tube.
+func peekTube(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs, peek func(geanstalkd.Tube) (*geanstalkd.Job, error)) {
+	if len(cmdArgs) != 0 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	job, err := peek(ch.State.Used)
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+	writePeekResponse(ch, job, err)
+}
+
+func writePeekResponse(ch connectionHandler, job *geanstalkd.Job, err error) {
+	if err != nil {
+		ch.Conn.Writer.PrintfLine("NOT_FOUND")
+		return
+	}
+
+	switch err := writeJob(ch, "FOUND", job); err {
+	case nil:
+	case geanstalkd.ErrJobMissing:
+		// Deleted after it was peeked.
+		ch.Conn.Writer.PrintfLine("NOT_FOUND")
+	default:
+		log.Println("Could not read body of job", job.ID, ":", err)
+		ch.Conn.Writer.PrintfLine("INTERNAL_ERROR")
+	}
+}
+
+// writeJob writes a response with a job's ID and body. Bodies spilled out of
+// memory are streamed to the client. If the body can't be opened, nothing is
+// written and the error is returned.
+func writeJob(ch connectionHandler, response string, job *geanstalkd.Job) error {
+	body, err := ch.Server.OpenBody(job)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	ch.Conn.Writer.PrintfLine("%s %d %d", response, job.ID, job.BodySize())
+	w := ch.Conn.Writer.W
+	if _, err := io.Copy(w, body); err != nil {
+		// The client has received part of the body. There is no way to tell
+		// it something went wrong.
+		log.Println("Could not read body of job", job.ID, ":", err)
+		ch.CloseConnection()
+		return nil
+	}
+	w.WriteString("\r\n")
+	w.Flush()
+	return nil
+}
+
+// writeReserved writes a response with a job reserved by the client. If its
+// body can't be read, the job is released, so that it isn't left reserved by
+// a client which doesn't know about it.
+func writeReserved(ch connectionHandler, job *geanstalkd.Job) {
+	err := writeJob(ch, "RESERVED", job)
+	if err == nil {
+		return
+	}
+	log.Println("Could not read body of job", job.ID, ":", err)
+	if err := ch.Server.Release(ch.Client, job.ID, job.Priority, 0); err != nil && err != geanstalkd.ErrJobMissing {
+		log.Println("Could not release job", job.ID, ":", err)
+	}
+	ch.Conn.Writer.PrintfLine("INTERNAL_ERROR")
+}
+
+const maxTubeNameLength = 200
+
+// validTubeName returns whether name is a legal tube name according to the
+// protocol.
+func validTubeName(name string) bool {
+	if len(name) == 0 || len(name) > maxTubeNameLength || name[0] == '-' {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("-+/;.$_()", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseTubeName returns the tube name in cmdArgs. Returns false if it's
+// missing or illegal.
+func parseTubeName(cmdArgs cmdArgs) (geanstalkd.Tube, bool) {
+	if len(cmdArgs) != 1 || !validTubeName(cmdArgs[0]) {
+		return "", false
+	}
+	return geanstalkd.Tube(cmdArgs[0]), true
+}
+
+func useHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	tube, ok := parseTubeName(cmdArgs)
+	if !ok {
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	if tube != ch.State.Used {
+		ch.Server.Use(tube)
+		ch.Server.Unuse(ch.State.Used)
+		ch.State.Used = tube
+	}
+	ch.Conn.Writer.PrintfLine("USING %s", tube)
+}
+
+func watchHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	tube, ok := parseTubeName(cmdArgs)
+	if !ok {
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	if ch.State.watch(tube) {
+		ch.rewatch()
+	}
+	ch.Conn.Writer.PrintfLine("WATCHING %d", len(ch.State.Watched))
+}
+
+func ignoreHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	tube, ok := parseTubeName(cmdArgs)
+	if !ok {
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	changed, ok := ch.State.ignore(tube)
+	if !ok {
+		ch.Conn.Writer.PrintfLine("NOT_IGNORED")
+		return
+	}
+	if changed {
+		ch.rewatch()
+	}
+	ch.Conn.Writer.PrintfLine("WATCHING %d", len(ch.State.Watched))
+}
+
+func pauseTubeHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	if len(cmdArgs) != 2 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	tube, ok := parseTubeName(cmdArgs[:1])
+	p := new(integerParser)
+	delay := p.Parse(cmdArgs[1])
+	if !ok || p.Err != nil || delay > math.MaxUint32 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	err := ch.Server.PauseTube(tube, time.Duration(delay)*time.Second)
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if err != nil {
+		ch.Conn.Writer.PrintfLine("NOT_FOUND")
+		return
+	}
+
+	ch.Conn.Writer.PrintfLine("PAUSED")
+}
+
+func drainHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if len(cmdArgs) != 0 {
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Server.SetDraining(true)
+	ch.Conn.Writer.PrintfLine("DRAINING")
+}
+
+func undrainHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if len(cmdArgs) != 0 {
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Server.SetDraining(false)
+	ch.Conn.Writer.PrintfLine("NOT_DRAINING")
+}
+
 func unknownCommandHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
 	ch.Conn.Pipeline.EndRequest(pipelineID)
 	ch.Conn.Pipeline.StartResponse(pipelineID)
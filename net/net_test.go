@@ -3,10 +3,14 @@ package net
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"net/textproto"
+	"strings"
 
 	"github.com/JensRantil/geanstalkd"
 	"github.com/JensRantil/geanstalkd/inmemory"
+	"github.com/JensRantil/geanstalkd/ondisk"
 	"github.com/google/btree"
 
 	. "testing"
@@ -24,12 +28,48 @@ func TestPut(t *T) {
 
 func TestPutWithBadFormat(t *T) {
 	t.Parallel()
+	testInput("put 0 4294967296 10 5\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+	testInput("put 0 0 4294967296 5\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
 	testInput("put 0 0 10\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
 	testInput("put 0 0\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
 	testInput("put 0\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
 	testInput("put\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
 }
 
+func TestPutTooBig(t *T) {
+	t.Parallel()
+
+	srv, closeServer := newTestServer()
+	defer closeServer()
+	srv.MaxJobSize = 4
+
+	input := testInput("put 0 0 10 5\r\nhello\r\nput 0 0 10 4\r\nhell\r\n")
+	if output := input.OutputFrom(t, srv, 1); output != "JOB_TOO_BIG\r\nINSERTED 1\r\n" {
+		t.Errorf("Unexpected output: %q", output)
+	}
+
+	// The body is skipped without being allocated, until the connection is
+	// closed.
+	testInput("put 0 0 10 99999999999\r\nhello\r\n").ExpectingOutput(t, "")
+}
+
+func TestPutOutOfMemory(t *T) {
+	t.Parallel()
+
+	srv, closeServer := newTestServer()
+	defer closeServer()
+	srv.Memory = geanstalkd.NewMemoryBudget(10)
+	srv.Memory.Add(6)
+
+	input := testInput("put 0 0 10 5\r\nhello\r\nput 0 0 10 4\r\nhell\r\n")
+	if output := input.OutputFrom(t, srv, 1); output != "OUT_OF_MEMORY\r\nINSERTED 1\r\n" {
+		t.Errorf("Unexpected output: %q", output)
+	}
+	if used := srv.Memory.Used(); used != 6 {
+		t.Error("Expected the received body to be freed. Used:", used)
+	}
+}
+
 func TestUnknownCommand(t *T) {
 	t.Parallel()
 	testInput("this is a test\r\n").ExpectingOutput(t, "UNKNOWN_COMMAND\r\n")
@@ -41,6 +81,448 @@ func TestQuitCommand(t *T) {
 	testInput("quit\r\nthis is a test").ExpectingOutput(t, "")
 }
 
+func TestDrain(t *T) {
+	t.Parallel()
+	testInput("put 0 0 10 5\r\nhello\r\ndrain\r\nput 0 0 10 5\r\nhello\r\nreserve\r\ndelete 1\r\nundrain\r\nput 0 0 10 5\r\nhello\r\n").ExpectingOutput(t, "INSERTED 1\r\nDRAINING\r\nDRAINING\r\nRESERVED 1 5\r\nhello\r\nDELETED\r\nNOT_DRAINING\r\nINSERTED 3\r\n")
+	testInput("drain 1\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+	testInput("undrain 1\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestReserve(t *T) {
+	t.Parallel()
+	testInput("put 0 0 10 5\r\nhello\r\nreserve\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\n")
+}
+
+func TestReserveWithBadFormat(t *T) {
+	t.Parallel()
+	testInput("reserve 1\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+	testInput("reserve-with-timeout\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+	testInput("reserve-with-timeout abc\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestReserveWithTimeout(t *T) {
+	t.Parallel()
+	testInput("put 0 0 10 5\r\nhello\r\nreserve-with-timeout 0\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\n")
+	testInput("reserve-with-timeout 0\r\n").ExpectingOutput(t, "TIMED_OUT\r\n")
+	testInput("put 0 0 10 5\r\nhello\r\nreserve\r\nreserve-with-timeout 0\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\nTIMED_OUT\r\n")
+	testInput("reserve-with-timeout 4294967296\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestReserveDelayed(t *T) {
+	t.Parallel()
+	testInput("put 0 1 10 5\r\nhello\r\nreserve-with-timeout 0\r\nreserve-with-timeout 3\r\n").ExpectingOutput(t, "INSERTED 1\r\nTIMED_OUT\r\nRESERVED 1 5\r\nhello\r\n")
+}
+
+func TestReserveJob(t *T) {
+	t.Parallel()
+	testInput("put 5 0 10 5\r\nfirst\r\nput 10 0 10 6\r\nsecond\r\nreserve-job 2\r\nreserve\r\n").ExpectingOutput(t, "INSERTED 1\r\nINSERTED 2\r\nRESERVED 2 6\r\nsecond\r\nRESERVED 1 5\r\nfirst\r\n")
+	testInput("put 0 100 10 5\r\nhello\r\nreserve-job 1\r\nrelease 1 0 0\r\nreserve-with-timeout 0\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\nRELEASED\r\nRESERVED 1 5\r\nhello\r\n")
+	testInput("put 0 0 10 5\r\nhello\r\nreserve\r\nbury 1 0\r\nreserve-job 1\r\npeek-buried\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\nBURIED\r\nRESERVED 1 5\r\nhello\r\nNOT_FOUND\r\n")
+	testInput("put 0 0 10 5\r\nhello\r\nreserve\r\nreserve-job 1\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\nNOT_FOUND\r\n")
+	testInput("reserve-job 1\r\n").ExpectingOutput(t, "NOT_FOUND\r\n")
+	testInput("reserve-job\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestRelease(t *T) {
+	t.Parallel()
+	testInput("put 0 0 10 5\r\nhello\r\nreserve\r\nrelease 1 0 0\r\nreserve\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\nRELEASED\r\nRESERVED 1 5\r\nhello\r\n")
+	testInput("put 0 0 10 5\r\nhello\r\nreserve\r\nrelease 1 0 1\r\nreserve-with-timeout 0\r\nreserve-with-timeout 3\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\nRELEASED\r\nTIMED_OUT\r\nRESERVED 1 5\r\nhello\r\n")
+}
+
+func TestReleaseWithNewPriority(t *T) {
+	t.Parallel()
+	testInput("put 5 0 10 5\r\nfirst\r\nput 10 0 10 6\r\nsecond\r\nreserve\r\nrelease 1 20 0\r\nreserve\r\n").ExpectingOutput(t, "INSERTED 1\r\nINSERTED 2\r\nRESERVED 1 5\r\nfirst\r\nRELEASED\r\nRESERVED 2 6\r\nsecond\r\n")
+}
+
+func TestReleaseNotReserved(t *T) {
+	t.Parallel()
+	testInput("release 1 0 0\r\n").ExpectingOutput(t, "NOT_FOUND\r\n")
+	testInput("put 0 0 10 5\r\nhello\r\nrelease 1 0 0\r\n").ExpectingOutput(t, "INSERTED 1\r\nNOT_FOUND\r\n")
+	testInput("release 1 0\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+	testInput("release 1 0 4294967296\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestReservedJobsAreReleasedOnDisconnect(t *T) {
+	t.Parallel()
+	srv, closeServer := newTestServer()
+	defer closeServer()
+
+	worker := testInput("put 5 0 100 5\r\nfirst\r\nput 7 0 100 6\r\nsecond\r\nput 9 0 100 5\r\nthird\r\nreserve\r\nreserve\r\ndelete 2\r\n").OutputFrom(t, srv, 1)
+	if expected := "INSERTED 1\r\nINSERTED 2\r\nINSERTED 3\r\nRESERVED 1 5\r\nfirst\r\nRESERVED 2 6\r\nsecond\r\nDELETED\r\n"; worker != expected {
+		t.Errorf("Unexpected output. Output: %s Expected: %s", worker, expected)
+	}
+
+	// The released job keeps its priority and is reserved before job 3.
+	other := testInput("reserve-with-timeout 0\r\nreserve-with-timeout 0\r\nreserve-with-timeout 0\r\nstats-job 1\r\n").OutputFrom(t, srv, 2)
+	expected := "RESERVED 1 5\r\nfirst\r\nRESERVED 3 5\r\nthird\r\nTIMED_OUT\r\n" +
+		yamlResponse("id: 1", "tube: default", "state: reserved", "pri: 5", "age: 0", "delay: 0", "ttr: 100", "time-left: 99", "file: 0",
+			"reserves: 2", "timeouts: 0", "releases: 0", "buries: 0", "kicks: 0")
+	if other != expected {
+		t.Errorf("Unexpected output. Output: %s Expected: %s", other, expected)
+	}
+}
+
+func TestTouch(t *T) {
+	t.Parallel()
+	testInput("put 0 0 10 5\r\nhello\r\nreserve\r\ntouch 1\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\nTOUCHED\r\n")
+	testInput("put 0 0 10 5\r\nhello\r\ntouch 1\r\n").ExpectingOutput(t, "INSERTED 1\r\nNOT_FOUND\r\n")
+	testInput("touch\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestBury(t *T) {
+	t.Parallel()
+	testInput("put 0 0 10 5\r\nhello\r\nreserve\r\nbury 1 0\r\nreserve-with-timeout 0\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\nBURIED\r\nTIMED_OUT\r\n")
+	testInput("put 0 0 10 5\r\nhello\r\nbury 1 0\r\n").ExpectingOutput(t, "INSERTED 1\r\nNOT_FOUND\r\n")
+	testInput("bury 1\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestKick(t *T) {
+	t.Parallel()
+	testInput("put 0 0 10 5\r\nhello\r\nreserve\r\nbury 1 0\r\nkick 10\r\nreserve\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\nBURIED\r\nKICKED 1\r\nRESERVED 1 5\r\nhello\r\n")
+	testInput("put 0 100 10 5\r\nhello\r\nkick 10\r\nreserve\r\n").ExpectingOutput(t, "INSERTED 1\r\nKICKED 1\r\nRESERVED 1 5\r\nhello\r\n")
+	testInput("kick 10\r\n").ExpectingOutput(t, "KICKED 0\r\n")
+	testInput("kick\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+// failingJobRegistry fails to insert jobs with the body "fail" and to update
+// jobs with the body "stuck", like a JobRegistry writing to a full disk. The
+// first update of a job with the body "flaky" fails too.
+type failingJobRegistry struct {
+	geanstalkd.JobRegistry
+
+	flaked map[geanstalkd.JobID]bool
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (r failingJobRegistry) Insert(j *geanstalkd.Job) error {
+	if string(j.Body) == "fail" {
+		return errDiskFull
+	}
+	return r.JobRegistry.Insert(j)
+}
+
+func (r failingJobRegistry) Update(j *geanstalkd.Job) error {
+	if string(j.Body) == "stuck" {
+		return errDiskFull
+	}
+	if string(j.Body) == "flaky" && !r.flaked[j.ID] {
+		r.flaked[j.ID] = true
+		return errDiskFull
+	}
+	return r.JobRegistry.Update(j)
+}
+
+// failingInput runs input through a server storing jobs in a
+// failingJobRegistry.
+func failingInput(t *T, input string) string {
+	srv, closeServer := newTestServerWithJobs(failingJobRegistry{
+		inmemory.NewBTreeJobRegistry(btree.New(DefaultBTreeDegree)),
+		make(map[geanstalkd.JobID]bool),
+	})
+	defer closeServer()
+	return testInput(input).OutputFrom(t, srv, 1)
+}
+
+func TestStorageErrors(t *T) {
+	t.Parallel()
+
+	// The connection is kept open after an error.
+	if output := failingInput(t, "put 0 0 10 4\r\nfail\r\nput 0 0 10 5\r\nhello\r\n"); output != "INTERNAL_ERROR\r\nINSERTED 2\r\n" {
+		t.Errorf("Unexpected output after failed put: %q", output)
+	}
+	if output := failingInput(t, "put 0 100 10 5\r\nstuck\r\nkick 10\r\nlist-tube-used\r\n"); output != "INSERTED 1\r\nINTERNAL_ERROR\r\nUSING default\r\n" {
+		t.Errorf("Unexpected output after failed kick: %q", output)
+	}
+	if output := failingInput(t, "put 0 0 10 5\r\nstuck\r\nreserve\r\nlist-tube-used\r\n"); output != "INSERTED 1\r\nINTERNAL_ERROR\r\nUSING default\r\n" {
+		t.Errorf("Unexpected output after failed reserve: %q", output)
+	}
+
+	// A job is left unchanged by a failed update, so that it can be retried.
+	for _, c := range []struct{ input, output string }{
+		{
+			"put 0 0 10 5\r\nflaky\r\nreserve\r\nreserve-with-timeout 0\r\n",
+			"INSERTED 1\r\nINTERNAL_ERROR\r\nRESERVED 1 5\r\nflaky\r\n",
+		},
+		{
+			"put 0 100 10 5\r\nflaky\r\nkick 10\r\nkick 10\r\nreserve-with-timeout 0\r\n",
+			"INSERTED 1\r\nINTERNAL_ERROR\r\nKICKED 1\r\nRESERVED 1 5\r\nflaky\r\n",
+		},
+	} {
+		if output := failingInput(t, c.input+"stats-tube default\r\n"); !strings.HasPrefix(output, c.output) ||
+			!strings.Contains(output, "\ncurrent-jobs-reserved: 1\n") || !strings.Contains(output, "\ncurrent-jobs-delayed: 0\n") {
+			t.Errorf("Unexpected output after retried update: %q", output)
+		}
+	}
+}
+
+func TestKickPrefersBuried(t *T) {
+	t.Parallel()
+	testInput("put 0 100 10 7\r\ndelayed\r\nput 0 0 10 6\r\nburied\r\nreserve\r\nbury 2 0\r\nkick 10\r\nkick 10\r\n").ExpectingOutput(t, "INSERTED 1\r\nINSERTED 2\r\nRESERVED 2 6\r\nburied\r\nBURIED\r\nKICKED 1\r\nKICKED 1\r\n")
+}
+
+func TestKickJob(t *T) {
+	t.Parallel()
+	testInput("put 0 100 10 5\r\nhello\r\nkick-job 1\r\nreserve\r\n").ExpectingOutput(t, "INSERTED 1\r\nKICKED\r\nRESERVED 1 5\r\nhello\r\n")
+	testInput("put 0 0 10 5\r\nhello\r\nkick-job 1\r\n").ExpectingOutput(t, "INSERTED 1\r\nNOT_FOUND\r\n")
+	testInput("kick-job 1\r\n").ExpectingOutput(t, "NOT_FOUND\r\n")
+}
+
+func TestUse(t *T) {
+	t.Parallel()
+	testInput("use foo\r\n").ExpectingOutput(t, "USING foo\r\n")
+	testInput("use foo\r\nput 0 0 10 5\r\nhello\r\nreserve-with-timeout 0\r\n").ExpectingOutput(t, "USING foo\r\nINSERTED 1\r\nTIMED_OUT\r\n")
+	testInput("use -foo\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+	testInput("use foo!\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+	testInput("use\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestWatch(t *T) {
+	t.Parallel()
+	testInput("watch foo\r\nwatch foo\r\n").ExpectingOutput(t, "WATCHING 2\r\nWATCHING 2\r\n")
+	testInput("use foo\r\nput 0 0 10 5\r\nhello\r\nwatch foo\r\nreserve-with-timeout 0\r\n").ExpectingOutput(t, "USING foo\r\nINSERTED 1\r\nWATCHING 2\r\nRESERVED 1 5\r\nhello\r\n")
+	testInput("watch\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestIgnore(t *T) {
+	t.Parallel()
+	testInput("ignore default\r\n").ExpectingOutput(t, "NOT_IGNORED\r\n")
+	testInput("watch foo\r\nignore default\r\nignore foo\r\n").ExpectingOutput(t, "WATCHING 2\r\nWATCHING 1\r\nNOT_IGNORED\r\n")
+	testInput("ignore bar\r\n").ExpectingOutput(t, "WATCHING 1\r\n")
+	testInput("put 0 0 10 5\r\nhello\r\nwatch foo\r\nignore default\r\nreserve-with-timeout 0\r\n").ExpectingOutput(t, "INSERTED 1\r\nWATCHING 2\r\nWATCHING 1\r\nTIMED_OUT\r\n")
+}
+
+func TestReserveAcrossTubes(t *T) {
+	t.Parallel()
+	testInput("use foo\r\nput 5 0 10 3\r\nfoo\r\nuse bar\r\nput 1 0 10 3\r\nbar\r\nwatch foo\r\nwatch bar\r\nreserve\r\nreserve\r\n").ExpectingOutput(t, "USING foo\r\nINSERTED 1\r\nUSING bar\r\nINSERTED 2\r\nWATCHING 2\r\nWATCHING 3\r\nRESERVED 2 3\r\nbar\r\nRESERVED 1 3\r\nfoo\r\n")
+}
+
+func TestKickUsedTube(t *T) {
+	t.Parallel()
+	testInput("put 0 100 10 5\r\nhello\r\nuse foo\r\nkick 10\r\n").ExpectingOutput(t, "INSERTED 1\r\nUSING foo\r\nKICKED 0\r\n")
+}
+
+func TestReserveWithDeadlineSoon(t *T) {
+	t.Parallel()
+	testInput("put 0 0 1 5\r\nhello\r\nreserve\r\nreserve\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\nDEADLINE_SOON\r\n")
+}
+
+func TestPeek(t *T) {
+	t.Parallel()
+	testInput("put 0 0 10 5\r\nhello\r\npeek 1\r\nreserve\r\npeek 1\r\n").ExpectingOutput(t, "INSERTED 1\r\nFOUND 1 5\r\nhello\r\nRESERVED 1 5\r\nhello\r\nFOUND 1 5\r\nhello\r\n")
+	testInput("peek 1\r\n").ExpectingOutput(t, "NOT_FOUND\r\n")
+	testInput("peek\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+	testInput("peek abc\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestSpilledBodies(t *T) {
+	t.Parallel()
+
+	bodies, err := ondisk.OpenBodyStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal("Could not open body store:", err)
+	}
+	defer bodies.Close()
+	srv, closeServer := newTestServerWithStorage(func(s *geanstalkd.StorageService) {
+		s.Jobs = geanstalkd.NewSpillingJobRegistry(s.Jobs)
+		s.Bodies = bodies
+		s.SpillSize = 6
+	})
+	defer closeServer()
+
+	input := testInput("put 0 0 10 5\r\nsmall\r\nput 0 0 10 7\r\nspilled\r\npeek 2\r\nreserve\r\nreserve\r\ndelete 2\r\npeek 2\r\n")
+	expected := "INSERTED 1\r\nINSERTED 2\r\nFOUND 2 7\r\nspilled\r\nRESERVED 1 5\r\nsmall\r\nRESERVED 2 7\r\nspilled\r\nDELETED\r\nNOT_FOUND\r\n"
+	if output := input.OutputFrom(t, srv, 1); output != expected {
+		t.Errorf("Unexpected output. Output: %q Expected: %q", output, expected)
+	}
+
+	job, err := srv.Peek(1)
+	if err != nil || job.Body == nil || job.BodyRef != nil {
+		t.Error("Expected the small body to be kept in memory. Got:", job, err)
+	}
+}
+
+func TestReserveUnreadableBody(t *T) {
+	t.Parallel()
+
+	bodies, err := ondisk.OpenBodyStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal("Could not open body store:", err)
+	}
+	srv, closeServer := newTestServerWithStorage(func(s *geanstalkd.StorageService) {
+		s.Jobs = geanstalkd.NewSpillingJobRegistry(s.Jobs)
+		s.Bodies = bodies
+	})
+	defer closeServer()
+
+	if output := testInput("put 0 0 10 4\r\ngone\r\n").OutputFrom(t, srv, 1); output != "INSERTED 1\r\n" {
+		t.Fatal("Unexpected output:", output)
+	}
+	// Removes the body file.
+	bodies.Close()
+
+	if output := testInput("reserve\r\n").OutputFrom(t, srv, 2); output != "INTERNAL_ERROR\r\n" {
+		t.Error("Unexpected output:", output)
+	}
+	job, err := srv.Peek(1)
+	if err != nil || job.State != geanstalkd.StateReady {
+		t.Error("Expected the job to be released. Got:", job, err)
+	}
+}
+
+func TestPeekReady(t *T) {
+	t.Parallel()
+	testInput("peek-ready\r\n").ExpectingOutput(t, "NOT_FOUND\r\n")
+	testInput("put 5 0 10 5\r\nfirst\r\nput 1 0 10 6\r\nsecond\r\npeek-ready\r\npeek-ready\r\n").ExpectingOutput(t, "INSERTED 1\r\nINSERTED 2\r\nFOUND 2 6\r\nsecond\r\nFOUND 2 6\r\nsecond\r\n")
+	testInput("put 0 0 10 5\r\nhello\r\nuse foo\r\npeek-ready\r\n").ExpectingOutput(t, "INSERTED 1\r\nUSING foo\r\nNOT_FOUND\r\n")
+	testInput("peek-ready 1\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestPeekDelayed(t *T) {
+	t.Parallel()
+	testInput("peek-delayed\r\n").ExpectingOutput(t, "NOT_FOUND\r\n")
+	testInput("put 0 200 10 5\r\nlater\r\nput 0 100 10 6\r\nsooner\r\nput 0 0 10 3\r\nnow\r\npeek-delayed\r\n").ExpectingOutput(t, "INSERTED 1\r\nINSERTED 2\r\nINSERTED 3\r\nFOUND 2 6\r\nsooner\r\n")
+}
+
+func TestPeekBuried(t *T) {
+	t.Parallel()
+	testInput("peek-buried\r\n").ExpectingOutput(t, "NOT_FOUND\r\n")
+	testInput("put 0 0 10 5\r\nhello\r\nreserve\r\nbury 1 0\r\npeek-buried\r\nkick 1\r\npeek-buried\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\nBURIED\r\nFOUND 1 5\r\nhello\r\nKICKED 1\r\nNOT_FOUND\r\n")
+}
+
+func TestStatsJob(t *T) {
+	t.Parallel()
+	testInput("put 5 0 10 5\r\nhello\r\nstats-job 1\r\n").ExpectingOutput(t, "INSERTED 1\r\n"+
+		yamlResponse("id: 1", "tube: default", "state: ready", "pri: 5", "age: 0", "delay: 0", "ttr: 10", "time-left: 0", "file: 0",
+			"reserves: 0", "timeouts: 0", "releases: 0", "buries: 0", "kicks: 0"))
+	testInput("put 5 0 10 5\r\nhello\r\nreserve\r\nstats-job 1\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\n"+
+		yamlResponse("id: 1", "tube: default", "state: reserved", "pri: 5", "age: 0", "delay: 0", "ttr: 10", "time-left: 9", "file: 0",
+			"reserves: 1", "timeouts: 0", "releases: 0", "buries: 0", "kicks: 0"))
+	testInput("put 5 0 10 5\r\nhello\r\nreserve\r\nrelease 1 7 100\r\nstats-job 1\r\nkick-job 1\r\nstats-job 1\r\n").ExpectingOutput(t, "INSERTED 1\r\nRESERVED 1 5\r\nhello\r\nRELEASED\r\n"+
+		yamlResponse("id: 1", "tube: default", "state: delayed", "pri: 7", "age: 0", "delay: 100", "ttr: 10", "time-left: 99", "file: 0",
+			"reserves: 1", "timeouts: 0", "releases: 1", "buries: 0", "kicks: 0")+
+		"KICKED\r\n"+
+		yamlResponse("id: 1", "tube: default", "state: ready", "pri: 7", "age: 0", "delay: 100", "ttr: 10", "time-left: 0", "file: 0",
+			"reserves: 1", "timeouts: 0", "releases: 1", "buries: 0", "kicks: 1"))
+	testInput("stats-job 1\r\n").ExpectingOutput(t, "NOT_FOUND\r\n")
+	testInput("stats-job\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestStatsTube(t *T) {
+	t.Parallel()
+	testInput("put 5 0 10 5\r\nhello\r\nput 2000 0 10 5\r\nhello\r\nput 0 100 10 5\r\nhello\r\nreserve\r\ndelete 1\r\nstats-tube default\r\n").ExpectingOutput(t, "INSERTED 1\r\nINSERTED 2\r\nINSERTED 3\r\nRESERVED 1 5\r\nhello\r\nDELETED\r\n"+
+		yamlResponse("name: default", "current-jobs-urgent: 0", "current-jobs-ready: 1", "current-jobs-reserved: 0", "current-jobs-delayed: 1",
+			"current-jobs-buried: 0", "total-jobs: 3", "current-using: 1", "current-watching: 1", "current-waiting: 0", "cmd-delete: 1",
+			"cmd-pause-tube: 0", "pause: 0", "pause-time-left: 0"))
+	testInput("use foo\r\nput 0 0 10 5\r\nhello\r\nwatch foo\r\nreserve\r\nstats-tube foo\r\n").ExpectingOutput(t, "USING foo\r\nINSERTED 1\r\nWATCHING 2\r\nRESERVED 1 5\r\nhello\r\n"+
+		yamlResponse("name: foo", "current-jobs-urgent: 0", "current-jobs-ready: 0", "current-jobs-reserved: 1", "current-jobs-delayed: 0",
+			"current-jobs-buried: 0", "total-jobs: 1", "current-using: 1", "current-watching: 1", "current-waiting: 0", "cmd-delete: 0",
+			"cmd-pause-tube: 0", "pause: 0", "pause-time-left: 0"))
+	testInput("stats-tube foo\r\n").ExpectingOutput(t, "NOT_FOUND\r\n")
+	testInput("stats-tube\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestListTubes(t *T) {
+	t.Parallel()
+	testInput("list-tubes\r\n").ExpectingOutput(t, yamlResponse("- default"))
+	testInput("use foo\r\nwatch bar\r\nlist-tubes\r\n").ExpectingOutput(t, "USING foo\r\nWATCHING 2\r\n"+yamlResponse("- bar", "- default", "- foo"))
+	testInput("use foo\r\nuse baz\r\nwatch bar\r\nignore bar\r\nlist-tubes\r\n").ExpectingOutput(t, "USING foo\r\nUSING baz\r\nWATCHING 2\r\nWATCHING 1\r\n"+yamlResponse("- baz", "- default"))
+	testInput("use foo\r\nput 0 0 10 5\r\nhello\r\nuse default\r\nlist-tubes\r\n").ExpectingOutput(t, "USING foo\r\nINSERTED 1\r\nUSING default\r\n"+yamlResponse("- default", "- foo"))
+}
+
+func TestListTubeUsed(t *T) {
+	t.Parallel()
+	testInput("list-tube-used\r\nuse foo\r\nlist-tube-used\r\n").ExpectingOutput(t, "USING default\r\nUSING foo\r\nUSING foo\r\n")
+}
+
+func TestStatsCountsEveryCommand(t *T) {
+	t.Parallel()
+
+	output := testInput("reserve-job 1\r\nkick-job 1\r\ndrain\r\nundrain\r\nstats\r\n").Output(t)
+	for _, line := range []string{
+		"cmd-reserve-job: 1",
+		"cmd-kick-job: 1",
+		"cmd-drain: 1",
+		"cmd-undrain: 1",
+	} {
+		if !strings.Contains(output, "\n"+line+"\n") {
+			t.Errorf("Missing stats line %q in: %s", line, output)
+		}
+	}
+}
+
+func TestListTubesWatched(t *T) {
+	t.Parallel()
+	testInput("list-tubes-watched\r\n").ExpectingOutput(t, yamlResponse("- default"))
+	testInput("watch foo\r\nwatch bar\r\nignore default\r\nlist-tubes-watched\r\n").ExpectingOutput(t, "WATCHING 2\r\nWATCHING 3\r\nWATCHING 2\r\n"+yamlResponse("- foo", "- bar"))
+}
+
+func TestStats(t *T) {
+	t.Parallel()
+
+	output := testInput("put 0 0 10 5\r\nhello\r\nput 0 100 10 5\r\nhello\r\nreserve\r\npeek 2\r\nfoo\r\nstats\r\n").Output(t)
+	prefix := "INSERTED 1\r\nINSERTED 2\r\nRESERVED 1 5\r\nhello\r\nFOUND 2 5\r\nhello\r\nUNKNOWN_COMMAND\r\n"
+	if !strings.HasPrefix(output, prefix) {
+		t.Fatalf("Unexpected output. Output: %s Expected prefix: %s", output, prefix)
+	}
+
+	var size int
+	if _, err := fmt.Sscanf(output[len(prefix):], "OK %d\r\n", &size); err != nil {
+		t.Fatal("Could not parse stats header:", err)
+	}
+	data := output[strings.Index(output, "---"):]
+	if len(data) != size+len("\r\n") {
+		t.Errorf("Unexpected stats size. Size: %d Data: %s", size, data)
+	}
+
+	for _, line := range []string{
+		"current-jobs-reserved: 1",
+		"current-jobs-delayed: 1",
+		"cmd-put: 2",
+		"cmd-reserve: 1",
+		"cmd-peek: 1",
+		"cmd-stats: 1",
+		"total-jobs: 2",
+		"current-tubes: 1",
+		"current-connections: 1",
+		"current-producers: 1",
+		"current-workers: 1",
+		"current-waiting: 0",
+		"total-connections: 1",
+		"draining: false",
+	} {
+		if !strings.Contains(data, "\n"+line+"\n") {
+			t.Errorf("Missing stats line %q in: %s", line, data)
+		}
+	}
+	testInput("stats 1\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestPauseTube(t *T) {
+	t.Parallel()
+	testInput("put 0 0 10 5\r\nhello\r\npause-tube default 1\r\nreserve-with-timeout 0\r\nreserve-with-timeout 3\r\n").ExpectingOutput(t, "INSERTED 1\r\nPAUSED\r\nTIMED_OUT\r\nRESERVED 1 5\r\nhello\r\n")
+	testInput("pause-tube default 1\r\nput 0 0 10 5\r\nhello\r\nreserve-with-timeout 3\r\n").ExpectingOutput(t, "PAUSED\r\nINSERTED 1\r\nRESERVED 1 5\r\nhello\r\n")
+	testInput("pause-tube foo 1\r\n").ExpectingOutput(t, "NOT_FOUND\r\n")
+	testInput("pause-tube default\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+	testInput("pause-tube default abc\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+	testInput("pause-tube -foo 1\r\n").ExpectingOutput(t, "BAD_FORMAT\r\n")
+}
+
+func TestPauseTubeStats(t *T) {
+	t.Parallel()
+	testInput("pause-tube default 100\r\nstats-tube default\r\n").ExpectingOutput(t, "PAUSED\r\n"+
+		yamlResponse("name: default", "current-jobs-urgent: 0", "current-jobs-ready: 0", "current-jobs-reserved: 0", "current-jobs-delayed: 0",
+			"current-jobs-buried: 0", "total-jobs: 0", "current-using: 1", "current-watching: 1", "current-waiting: 0", "cmd-delete: 0",
+			"cmd-pause-tube: 1", "pause: 100", "pause-time-left: 99"))
+}
+
+// yamlResponse returns the expected OK response for a YAML document with the
+// given lines.
+func yamlResponse(lines ...string) string {
+	data := "---\n" + strings.Join(lines, "\n") + "\n"
+	return fmt.Sprintf("OK %d\r\n%s\r\n", len(data), data)
+}
+
 type mockedReadWriteCloser struct {
 	Input  *bytes.Buffer
 	Closed bool
@@ -76,21 +558,26 @@ func testInput(input string) inputOutputTest {
 const DefaultBTreeDegree = 16
 
 func (iot inputOutputTest) ExpectingOutput(t *T, expected string) {
-	ctx, cancel := context.WithCancel(context.Background())
-	ids := geanstalkd.GenerateIds(ctx)
-	srv := &geanstalkd.Server{
-		Storage: geanstalkd.NewLockService(
-			&geanstalkd.StorageService{
-				Jobs:       inmemory.NewBTreeJobRegistry(btree.New(DefaultBTreeDegree)),
-				ReadyQueue: inmemory.NewJobHeapPriorityQueue(),
-				DelayQueue: inmemory.NewJobHeapPriorityQueue(),
-			},
-		),
-		Ids: ids,
+	if output := iot.Output(t); output != expected {
+		t.Errorf("Unexpected output. Output: %s Expected: %s", output, expected)
 	}
+}
+
+// Output runs the input through a new server and returns the output.
+func (iot inputOutputTest) Output(t *T) string {
+	srv, closeServer := newTestServer()
+	defer closeServer()
+	return iot.OutputFrom(t, srv, 1)
+}
 
+// OutputFrom runs the input through a connection from client to srv and
+// returns the output.
+func (iot inputOutputTest) OutputFrom(t *T, srv *geanstalkd.Server, client geanstalkd.ClientID) string {
+	ctx, cancel := context.WithCancel(context.Background())
 	ch := connectionHandler{
 		srv,
+		client,
+		newConnectionState(),
 		ctx,
 		cancel,
 		textproto.NewConn(iot.mrwc),
@@ -101,13 +588,53 @@ func (iot inputOutputTest) ExpectingOutput(t *T, expected string) {
 		t.Error("Connection was not closed.")
 	}
 
-	if output := iot.mrwc.output.String(); output != expected {
-		t.Errorf("Unexpected output. Output: %s Expected: %s", output, expected)
-	}
-
 	select {
 	case <-ctx.Done():
 	default:
 		t.Error("Context wasn't done.")
 	}
+
+	return iot.mrwc.output.String()
+}
+
+// newTestServer returns a new in-memory server and a function which stops it.
+func newTestServer() (*geanstalkd.Server, func()) {
+	return newTestServerWithJobs(inmemory.NewBTreeJobRegistry(btree.New(DefaultBTreeDegree)))
+}
+
+// newTestServerWithJobs creates a server which stores its jobs in jobs.
+func newTestServerWithJobs(jobs geanstalkd.JobRegistry) (*geanstalkd.Server, func()) {
+	return newTestServerWithStorage(func(s *geanstalkd.StorageService) { s.Jobs = jobs })
+}
+
+// newTestServerWithStorage creates a server whose in-memory storage is
+// modified by configure before being used.
+func newTestServerWithStorage(configure func(*geanstalkd.StorageService)) (*geanstalkd.Server, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ids := geanstalkd.GenerateIds(ctx)
+	stats := geanstalkd.NewMapStatisticsService()
+	storageService := &geanstalkd.StorageService{
+		Jobs:                 inmemory.NewBTreeJobRegistry(btree.New(DefaultBTreeDegree)),
+		DelayTubes:           inmemory.NewTubeHeapPriorityQueue(),
+		NewJobPriorityQueue:  func() geanstalkd.JobPriorityQueue { return inmemory.NewJobHeapPriorityQueue() },
+		NewJobQueue:          func() geanstalkd.JobQueue { return inmemory.NewJobListQueue() },
+		NewTubePriorityQueue: func() geanstalkd.TubePriorityQueue { return inmemory.NewTubeHeapPriorityQueue() },
+		Statistics:           stats,
+	}
+	configure(storageService)
+	storage := geanstalkd.NewLockService(storageService)
+	ttr := geanstalkd.NewHeapTTRService(storage)
+	delay := geanstalkd.NewPollingDelayService(storage)
+	srv := &geanstalkd.Server{
+		Storage:    storage,
+		TTR:        ttr,
+		Delay:      delay,
+		Statistics: stats,
+		Ids:        ids,
+	}
+	return srv, func() {
+		ttr.Close()
+		delay.Close()
+		cancel()
+	}
 }
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package net
+
+import "time"
+
+// rusage returns zero, since resource usage isn't available on this platform.
+func rusage() (utime, stime time.Duration) {
+	return 0, 0
+}
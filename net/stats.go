@@ -0,0 +1,269 @@
+package net
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// instanceID is a random identifier of this process, reported by stats.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// version returns the version of the main module, which is "(devel)" unless
+// the binary was built from a tagged module.
+func version() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return "(unknown)"
+}
+
+// statsCommands are the commands whose counters are reported by stats, in
+// order.
+var statsCommands = []string{
+	"put", "peek", "peek-ready", "peek-delayed", "peek-buried", "reserve",
+	"reserve-with-timeout", "touch", "use", "watch", "ignore", "delete",
+	"release", "bury", "kick", "stats", "stats-job", "stats-tube",
+	"list-tubes", "list-tube-used", "list-tubes-watched", "pause-tube",
+	"reserve-job", "kick-job", "drain", "undrain",
+}
+
+// yamlEntry is a key and a value in a YAML dictionary.
+type yamlEntry struct {
+	Key   string
+	Value interface{}
+}
+
+// writeYAMLDict writes an OK response containing entries as a YAML
+// dictionary, formatted like beanstalkd does.
+func writeYAMLDict(ch connectionHandler, entries []yamlEntry) {
+	var buf bytes.Buffer
+	buf.WriteString("---\n")
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%s: %v\n", e.Key, e.Value)
+	}
+
+	ch.Conn.Writer.PrintfLine("OK %d", buf.Len())
+	ch.Conn.Writer.PrintfLine("%s", buf.Bytes())
+}
+
+// writeYAMLList writes an OK response containing tubes as a YAML list,
+// formatted like beanstalkd does.
+func writeYAMLList(ch connectionHandler, tubes []geanstalkd.Tube) {
+	var buf bytes.Buffer
+	buf.WriteString("---\n")
+	for _, tube := range tubes {
+		fmt.Fprintf(&buf, "- %s\n", tube)
+	}
+
+	ch.Conn.Writer.PrintfLine("OK %d", buf.Len())
+	ch.Conn.Writer.PrintfLine("%s", buf.Bytes())
+}
+
+// seconds truncates d to whole seconds as used by the protocol.
+func seconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
+// rusageSeconds formats a CPU time the way beanstalkd does.
+func rusageSeconds(d time.Duration) string {
+	return fmt.Sprintf("%d.%06d", d/time.Second, (d%time.Second)/time.Microsecond)
+}
+
+func statsHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	if len(cmdArgs) != 0 {
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	storage := ch.Server.Stats()
+	counters := ch.Server.Statistics
+	hostname, _ := os.Hostname()
+	utime, stime := rusage()
+
+	entries := []yamlEntry{
+		{"current-jobs-urgent", storage.UrgentJobs},
+		{"current-jobs-ready", storage.ReadyJobs},
+		{"current-jobs-reserved", storage.ReservedJobs},
+		{"current-jobs-delayed", storage.DelayedJobs},
+		{"current-jobs-buried", storage.BuriedJobs},
+	}
+	for _, cmd := range statsCommands {
+		c := geanstalkd.CommandCounter(cmd)
+		entries = append(entries, yamlEntry{string(c), counters.Get(c)})
+	}
+	entries = append(entries, []yamlEntry{
+		{"job-timeouts", counters.Get(geanstalkd.CounterJobTimeouts)},
+		{"total-jobs", counters.Get(geanstalkd.CounterTotalJobs)},
+		{"max-job-size", ch.Server.JobSizeLimit()},
+		{"current-tubes", storage.Tubes},
+		{"current-connections", counters.Get(geanstalkd.CounterCurrentConnections)},
+		{"current-producers", counters.Get(geanstalkd.CounterCurrentProducers)},
+		{"current-workers", counters.Get(geanstalkd.CounterCurrentWorkers)},
+		{"current-waiting", storage.Waiting},
+		{"total-connections", counters.Get(geanstalkd.CounterTotalConnections)},
+		{"pid", os.Getpid()},
+		{"version", version()},
+		{"rusage-utime", rusageSeconds(utime)},
+		{"rusage-stime", rusageSeconds(stime)},
+		{"uptime", seconds(counters.Uptime())},
+		{"binlog-oldest-index", counters.Get(geanstalkd.CounterBinlogOldestIndex)},
+		{"binlog-current-index", counters.Get(geanstalkd.CounterBinlogCurrentIndex)},
+		{"binlog-records-migrated", counters.Get(geanstalkd.CounterBinlogRecordsMigrated)},
+		{"binlog-records-written", counters.Get(geanstalkd.CounterBinlogRecordsWritten)},
+		{"binlog-max-size", counters.Get(geanstalkd.CounterBinlogMaxSize)},
+		{"binlog-fsyncs", counters.Get(geanstalkd.CounterBinlogFsyncs)},
+		{"binlog-fsync-time", rusageSeconds(time.Duration(counters.Get(geanstalkd.CounterBinlogFsyncNanos)))},
+		{"draining", ch.Server.Draining()},
+		{"id", instanceID},
+		{"hostname", hostname},
+		{"os", runtime.GOOS},
+		{"platform", runtime.GOARCH},
+	}...)
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+	writeYAMLDict(ch, entries)
+}
+
+func statsJobHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	if len(cmdArgs) != 1 {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	p := new(integerParser)
+	id := p.Parse(cmdArgs[0])
+	if p.Err != nil {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	job, err := ch.Server.Peek(geanstalkd.JobID(id))
+	var timeLeft time.Duration
+	if err == nil {
+		timeLeft = ch.Server.TimeLeft(job)
+	}
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if err != nil {
+		ch.Conn.Writer.PrintfLine("NOT_FOUND")
+		return
+	}
+
+	writeYAMLDict(ch, []yamlEntry{
+		{"id", job.ID},
+		{"tube", job.Tube},
+		{"state", job.State},
+		{"pri", job.Priority},
+		{"age", seconds(time.Since(job.CreatedAt))},
+		{"delay", seconds(job.Delay)},
+		{"ttr", seconds(job.TimeToRun)},
+		{"time-left", seconds(timeLeft)},
+		// Which binlog file holds a job isn't tracked.
+		{"file", 0},
+		{"reserves", job.Stats.Reserves},
+		{"timeouts", job.Stats.Timeouts},
+		{"releases", job.Stats.Releases},
+		{"buries", job.Stats.Buries},
+		{"kicks", job.Stats.Kicks},
+	})
+}
+
+func statsTubeHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	tube, ok := parseTubeName(cmdArgs)
+	if !ok {
+		ch.Conn.Pipeline.EndRequest(pipelineID)
+		ch.Conn.Pipeline.StartResponse(pipelineID)
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+
+	stats, err := ch.Server.TubeStats(tube)
+
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if err != nil {
+		ch.Conn.Writer.PrintfLine("NOT_FOUND")
+		return
+	}
+
+	writeYAMLDict(ch, []yamlEntry{
+		{"name", stats.Name},
+		{"current-jobs-urgent", stats.UrgentJobs},
+		{"current-jobs-ready", stats.ReadyJobs},
+		{"current-jobs-reserved", stats.ReservedJobs},
+		{"current-jobs-delayed", stats.DelayedJobs},
+		{"current-jobs-buried", stats.BuriedJobs},
+		{"total-jobs", stats.TotalJobs},
+		{"current-using", stats.Using},
+		{"current-watching", stats.Watching},
+		{"current-waiting", stats.Waiting},
+		{"cmd-delete", stats.Deletes},
+		{"cmd-pause-tube", stats.Pauses},
+		{"pause", seconds(stats.Pause)},
+		{"pause-time-left", seconds(stats.PauseTimeLeft)},
+	})
+}
+
+func listTubesHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if len(cmdArgs) != 0 {
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	writeYAMLList(ch, ch.Server.Tubes())
+}
+
+func listTubeUsedHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if len(cmdArgs) != 0 {
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	ch.Conn.Writer.PrintfLine("USING %s", ch.State.Used)
+}
+
+func listTubesWatchedHandler(ch connectionHandler, pipelineID uint, cmdArgs cmdArgs) {
+	ch.Conn.Pipeline.EndRequest(pipelineID)
+	ch.Conn.Pipeline.StartResponse(pipelineID)
+
+	if len(cmdArgs) != 0 {
+		ch.Conn.Writer.PrintfLine("BAD_FORMAT")
+		return
+	}
+
+	writeYAMLList(ch, ch.State.Watched)
+}
@@ -0,0 +1,162 @@
+package ondisk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// DefaultMaxBodyFileSize is the size after which a BodyStore starts a new
+// file unless configured otherwise.
+const DefaultMaxBodyFileSize = 64 << 20
+
+func bodyFileName(file uint32) string {
+	return fmt.Sprintf("bodies.%d", file)
+}
+
+// BodyStore is a geanstalkd.BodyStore which appends bodies to files. A file is
+// removed once all bodies in it have been deleted, so a single long-lived
+// body keeps its whole file on disk. Use OpenBodyStore to create one.
+type BodyStore struct {
+	dir         string
+	maxFileSize int64
+
+	lock sync.Mutex
+	// file is the newest file, which bodies are appended to.
+	file    *os.File
+	current uint32
+	size    int64
+	// live is the number of bodies which haven't been deleted in every file.
+	live map[uint32]int
+}
+
+// OpenBodyStore creates a BodyStore keeping its files in dir, which is
+// created if it doesn't exist. A new file is started after maxFileSize bytes.
+// Files left behind by a previous BodyStore are removed, since bodies aren't
+// stored durably.
+func OpenBodyStore(dir string, maxFileSize int64) (*BodyStore, error) {
+	if maxFileSize <= 0 {
+		maxFileSize = DefaultMaxBodyFileSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := removeBodyFiles(dir); err != nil {
+		return nil, err
+	}
+
+	s := &BodyStore{dir: dir, maxFileSize: maxFileSize, live: make(map[uint32]int)}
+	if err := s.startFile(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func removeBodyFiles(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "bodies.*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BodyStore) path(file uint32) string {
+	return filepath.Join(s.dir, bodyFileName(file))
+}
+
+// startFile closes the current file and starts a new one.
+func (s *BodyStore) startFile() error {
+	f, err := os.OpenFile(s.path(s.current+1), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+		if s.live[s.current] == 0 {
+			delete(s.live, s.current)
+			os.Remove(s.path(s.current))
+		}
+	}
+	s.file = f
+	s.current++
+	s.size = 0
+	return nil
+}
+
+// Put appends a body to the newest file.
+func (s *BodyStore) Put(body []byte) (geanstalkd.BodyRef, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.size > 0 && s.size+int64(len(body)) > s.maxFileSize {
+		if err := s.startFile(); err != nil {
+			return geanstalkd.BodyRef{}, err
+		}
+	}
+	if _, err := s.file.Write(body); err != nil {
+		// Later bodies are appended after the partial one.
+		if info, serr := s.file.Stat(); serr == nil {
+			s.size = info.Size()
+		}
+		return geanstalkd.BodyRef{}, err
+	}
+
+	ref := geanstalkd.BodyRef{File: s.current, Offset: s.size, Size: len(body)}
+	s.size += int64(len(body))
+	s.live[s.current]++
+	return ref, nil
+}
+
+// bodyReader reads a body from its own handle of a file, so that the file
+// can be removed while it's being read.
+type bodyReader struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (r *bodyReader) Close() error {
+	return r.file.Close()
+}
+
+// Open returns a reader of a body.
+func (s *BodyStore) Open(ref geanstalkd.BodyRef) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(ref.File))
+	if err != nil {
+		return nil, err
+	}
+	return &bodyReader{io.NewSectionReader(f, ref.Offset, int64(ref.Size)), f}, nil
+}
+
+// Delete frees a body. Its file is removed if it was the last body in it.
+func (s *BodyStore) Delete(ref geanstalkd.BodyRef) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.live[ref.File]--
+	if s.live[ref.File] > 0 || ref.File == s.current {
+		return nil
+	}
+	delete(s.live, ref.File)
+	return os.Remove(s.path(ref.File))
+}
+
+// Close closes the store and removes its files.
+func (s *BodyStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.file.Close()
+	if rerr := removeBodyFiles(s.dir); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package ondisk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	. "testing"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+func bodyFiles(t *T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "bodies.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestBodyStore(t *T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, bodyFileName(7)), []byte("left behind"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenBodyStore(dir, 10)
+	if err != nil {
+		t.Fatal("Could not open body store:", err)
+	}
+	if files := bodyFiles(t, dir); len(files) != 1 {
+		t.Fatal("Expected old files to be removed. Got:", files)
+	}
+
+	// Every file fits two bodies.
+	var refs []geanstalkd.BodyRef
+	for i := 0; i < 6; i++ {
+		ref, err := s.Put([]byte(fmt.Sprint("body", i)))
+		if err != nil {
+			t.Fatal("Could not put body:", err)
+		}
+		refs = append(refs, ref)
+	}
+	if files := bodyFiles(t, dir); len(files) != 3 {
+		t.Fatal("Expected three files. Got:", files)
+	}
+
+	for i, ref := range refs {
+		r, err := s.Open(ref)
+		if err != nil {
+			t.Fatal("Could not open body:", err)
+		}
+		body, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(body) != fmt.Sprint("body", i) {
+			t.Fatalf("Unexpected body %d: %q, %v", i, body, err)
+		}
+	}
+
+	// A file is removed once all its bodies are deleted, unless bodies still
+	// are appended to it.
+	for _, i := range []int{0, 2, 4, 5} {
+		if err := s.Delete(refs[i]); err != nil {
+			t.Fatal("Could not delete body:", err)
+		}
+	}
+	if files := bodyFiles(t, dir); len(files) != 3 {
+		t.Fatal("Expected all files to be kept. Got:", files)
+	}
+	if err := s.Delete(refs[3]); err != nil {
+		t.Fatal("Could not delete body:", err)
+	}
+	if files := bodyFiles(t, dir); len(files) != 2 {
+		t.Fatal("Expected the second file to be removed. Got:", files)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal("Could not close body store:", err)
+	}
+	if files := bodyFiles(t, dir); len(files) != 0 {
+		t.Error("Expected all files to be removed. Got:", files)
+	}
+}
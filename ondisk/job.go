@@ -0,0 +1,145 @@
+package ondisk
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// idKey returns the tree key of a job ID. Big-endian keys are ordered like
+// the IDs.
+func idKey(id geanstalkd.JobID) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+func appendTime(b []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return binary.AppendVarint(b, 0)
+	}
+	return binary.AppendVarint(b, t.UnixNano())
+}
+
+// encodeJob encodes all fields of a job. A body in a BodyStore is encoded as
+// a reference to it.
+func encodeJob(j *geanstalkd.Job) []byte {
+	b := make([]byte, 0, 64+len(j.Tube)+len(j.Body))
+	b = binary.AppendUvarint(b, uint64(j.ID))
+	b = binary.AppendUvarint(b, uint64(len(j.Tube)))
+	b = append(b, j.Tube...)
+	b = binary.AppendUvarint(b, uint64(j.State))
+	b = binary.AppendUvarint(b, uint64(j.ReservedBy))
+	if j.RunnableAt != nil {
+		b = append(b, 1)
+		b = appendTime(b, *j.RunnableAt)
+	} else {
+		b = append(b, 0)
+	}
+	b = binary.AppendVarint(b, int64(j.TimeToRun))
+	b = binary.AppendUvarint(b, uint64(j.Priority))
+	b = appendTime(b, j.CreatedAt)
+	b = binary.AppendVarint(b, int64(j.Delay))
+	b = binary.AppendUvarint(b, j.Stats.Reserves)
+	b = binary.AppendUvarint(b, j.Stats.Timeouts)
+	b = binary.AppendUvarint(b, j.Stats.Releases)
+	b = binary.AppendUvarint(b, j.Stats.Buries)
+	b = binary.AppendUvarint(b, j.Stats.Kicks)
+	switch {
+	case j.BodyRef != nil:
+		b = append(b, 2)
+		b = binary.AppendUvarint(b, uint64(j.BodyRef.File))
+		b = binary.AppendVarint(b, j.BodyRef.Offset)
+		b = binary.AppendUvarint(b, uint64(j.BodyRef.Size))
+	case j.Body != nil:
+		b = append(b, 1)
+		b = append(b, j.Body...)
+	default:
+		b = append(b, 0)
+	}
+	return b
+}
+
+// jobDecoder reads the fields of an encoded job. Reading past the end sets
+// bad.
+type jobDecoder struct {
+	b   []byte
+	bad bool
+}
+
+func (d *jobDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.bad = true
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *jobDecoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.bad = true
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *jobDecoder) byte() byte {
+	if len(d.b) == 0 {
+		d.bad = true
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *jobDecoder) time() time.Time {
+	if nanos := d.varint(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+// decodeJob decodes a job encoded by encodeJob.
+func decodeJob(b []byte) (*geanstalkd.Job, error) {
+	d := &jobDecoder{b: b}
+	j := &geanstalkd.Job{ID: geanstalkd.JobID(d.uvarint())}
+	if n := d.uvarint(); n <= uint64(len(d.b)) {
+		j.Tube = geanstalkd.Tube(d.b[:n])
+		d.b = d.b[n:]
+	} else {
+		d.bad = true
+	}
+	j.State = geanstalkd.JobState(d.uvarint())
+	j.ReservedBy = geanstalkd.ClientID(d.uvarint())
+	if d.byte() == 1 {
+		at := d.time()
+		j.RunnableAt = &at
+	}
+	j.TimeToRun = time.Duration(d.varint())
+	j.Priority = geanstalkd.Priority(d.uvarint())
+	j.CreatedAt = d.time()
+	j.Delay = time.Duration(d.varint())
+	j.Stats.Reserves = d.uvarint()
+	j.Stats.Timeouts = d.uvarint()
+	j.Stats.Releases = d.uvarint()
+	j.Stats.Buries = d.uvarint()
+	j.Stats.Kicks = d.uvarint()
+	switch d.byte() {
+	case 1:
+		j.Body = append([]byte{}, d.b...)
+	case 2:
+		j.BodyRef = &geanstalkd.BodyRef{
+			File:   uint32(d.uvarint()),
+			Offset: d.varint(),
+			Size:   int(d.uvarint()),
+		}
+	}
+	if d.bad {
+		return nil, ErrBadFile
+	}
+	return j, nil
+}
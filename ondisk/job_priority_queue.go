@@ -0,0 +1,224 @@
+package ondisk
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// queueIndexMagic starts every QueueIndex file. Its last byte is the format
+// version.
+const queueIndexMagic = "geanstalkd-queues\x01"
+
+// The kinds of keys stored for every queue. An order key is a job's position
+// in the queue, and an ID key maps a job ID to its order key.
+const (
+	keyOrder byte = iota
+	keyID
+)
+
+// QueueIndex is a file holding the index entries of JobPriorityQueues. It
+// only stores the ID and the sort order of every job; the jobs themselves are
+// read from a JobRegistry. Use OpenQueueIndex to create one.
+//
+// The file lets queues grow larger than memory, but it doesn't persist them
+// across restarts. Queues are numbered in the order they are created, which
+// differs between runs, so a previous index can't be matched with the new
+// queues. Jobs outlive restarts in a binlog, from which the queues are
+// refilled.
+type QueueIndex struct {
+	lock   sync.Mutex
+	tree   *tree
+	jobs   geanstalkd.JobRegistry
+	queues uint32
+}
+
+// OpenQueueIndex creates a QueueIndex stored in a file. Jobs returned by its
+// queues are read from jobs, so a job must be inserted in, and updated in,
+// jobs before it is pushed or updated in a queue. At most cachePages pages are
+// cached in memory.
+//
+// An existing file is deliberately removed rather than reopened, since its
+// entries belong to the queues of a previous run. See QueueIndex.
+func OpenQueueIndex(path string, jobs geanstalkd.JobRegistry, cachePages int) (*QueueIndex, error) {
+	if cachePages <= 0 {
+		cachePages = DefaultCachePages
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	t, err := openTree(path, queueIndexMagic, cachePages)
+	if err != nil {
+		return nil, err
+	}
+	return &QueueIndex{tree: t, jobs: jobs}, nil
+}
+
+// NewJobPriorityQueue returns a new, empty queue stored in the index.
+func (x *QueueIndex) NewJobPriorityQueue() *JobPriorityQueue {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.queues++
+	return &JobPriorityQueue{index: x, id: x.queues}
+}
+
+// Close closes the file.
+func (x *QueueIndex) Close() error {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.tree.close()
+}
+
+// done evicts cached pages after an operation has finished. Returns err, or
+// the error evicting if err is nil.
+func (x *QueueIndex) done(err error) error {
+	if eerr := x.tree.evict(); err == nil {
+		err = eerr
+	}
+	return err
+}
+
+// JobPriorityQueue is a geanstalkd.JobPriorityQueue which keeps its index
+// entries in a QueueIndex. Jobs are ordered like geanstalkd.Less orders them.
+// Use QueueIndex.NewJobPriorityQueue to create one.
+type JobPriorityQueue struct {
+	index *QueueIndex
+	id    uint32
+}
+
+func (q *JobPriorityQueue) prefix(kind byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, q.id), kind)
+}
+
+func (q *JobPriorityQueue) idKey(id geanstalkd.JobID) []byte {
+	return binary.BigEndian.AppendUint64(q.prefix(keyID), uint64(id))
+}
+
+// orderKey returns a key which sorts like geanstalkd.Less sorts jobs. Jobs
+// with a RunnableAt come first.
+func (q *JobPriorityQueue) orderKey(j *geanstalkd.Job) []byte {
+	b := q.prefix(keyOrder)
+	if j.RunnableAt != nil {
+		// Flipping the sign bit sorts negative seconds first.
+		b = append(b, 0)
+		b = binary.BigEndian.AppendUint64(b, uint64(j.RunnableAt.Unix())^1<<63)
+		b = binary.BigEndian.AppendUint32(b, uint32(j.RunnableAt.Nanosecond()))
+	} else {
+		b = append(b, 1)
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(j.Priority))
+	return binary.BigEndian.AppendUint64(b, uint64(j.ID))
+}
+
+// head returns the order key and the job ID of the first job in the queue.
+func (q *JobPriorityQueue) head() ([]byte, geanstalkd.JobID, error) {
+	prefix := q.prefix(keyOrder)
+	key, _, err := q.index.tree.seek(prefix)
+	if err == errKeyMissing || err == nil && string(key[:len(prefix)]) != string(prefix) {
+		return nil, 0, geanstalkd.ErrEmptyQueue
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return key, geanstalkd.JobID(binary.BigEndian.Uint64(key[len(key)-8:])), nil
+}
+
+// Push adds a new job. If a job with the given ID already has been pushed,
+// geanstalkd.ErrJobAlreadyExist is returned.
+func (q *JobPriorityQueue) Push(j *geanstalkd.Job) error {
+	x := q.index
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	order := q.orderKey(j)
+	err := x.tree.put(q.idKey(j.ID), order, putInsert)
+	if err == errKeyExists {
+		return x.done(geanstalkd.ErrJobAlreadyExist)
+	} else if err != nil {
+		return x.done(err)
+	}
+	return x.done(x.tree.put(order, nil, putInsert))
+}
+
+// Update modifies a job previously pushed.
+func (q *JobPriorityQueue) Update(j *geanstalkd.Job) error {
+	x := q.index
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	idKey := q.idKey(j.ID)
+	old, err := x.tree.get(idKey)
+	if err == errKeyMissing {
+		return x.done(geanstalkd.ErrJobMissing)
+	} else if err != nil {
+		return x.done(err)
+	}
+	order := q.orderKey(j)
+	if string(old) == string(order) {
+		return x.done(nil)
+	}
+	if err := x.tree.delete(old); err != nil {
+		return x.done(err)
+	}
+	if err := x.tree.put(order, nil, putInsert); err != nil {
+		return x.done(err)
+	}
+	return x.done(x.tree.put(idKey, order, putReplace))
+}
+
+// Pop removes and returns the job with the highest priority.
+// geanstalkd.ErrEmptyQueue is returned if the queue is empty.
+func (q *JobPriorityQueue) Pop() (*geanstalkd.Job, error) {
+	x := q.index
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	order, id, err := q.head()
+	if err != nil {
+		return nil, x.done(err)
+	}
+	j, err := x.jobs.GetByID(id)
+	if err != nil {
+		return nil, x.done(err)
+	}
+	if err := x.tree.delete(order); err != nil {
+		return nil, x.done(err)
+	}
+	return j, x.done(x.tree.delete(q.idKey(id)))
+}
+
+// Peek returns the job which would be returned if Pop() is called.
+// geanstalkd.ErrEmptyQueue is returned if the queue is empty.
+func (q *JobPriorityQueue) Peek() (*geanstalkd.Job, error) {
+	x := q.index
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	_, id, err := q.head()
+	if err != nil {
+		return nil, x.done(err)
+	}
+	j, err := x.jobs.GetByID(id)
+	return j, x.done(err)
+}
+
+// RemoveByID removes a job with given ID previously pushed to this queue.
+// geanstalkd.ErrJobMissing if a job with the given ID could not be found.
+func (q *JobPriorityQueue) RemoveByID(id geanstalkd.JobID) error {
+	x := q.index
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	idKey := q.idKey(id)
+	order, err := x.tree.get(idKey)
+	if err == errKeyMissing {
+		return x.done(geanstalkd.ErrJobMissing)
+	} else if err != nil {
+		return x.done(err)
+	}
+	if err := x.tree.delete(idKey); err != nil {
+		return x.done(err)
+	}
+	return x.done(x.tree.delete(order))
+}
@@ -0,0 +1,172 @@
+package ondisk
+
+import (
+	"math/rand"
+	"path/filepath"
+	. "testing"
+	"time"
+
+	"github.com/google/btree"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/JensRantil/geanstalkd"
+	"github.com/JensRantil/geanstalkd/inmemory"
+	"github.com/JensRantil/geanstalkd/testing"
+)
+
+func openTestQueueIndex(t *T, jobs geanstalkd.JobRegistry, cachePages int) *QueueIndex {
+	x, err := OpenQueueIndex(filepath.Join(t.TempDir(), "queues"), jobs, cachePages)
+	if err != nil {
+		t.Fatal("Could not open queue index:", err)
+	}
+	return x
+}
+
+// registeringQueue stores pushed and updated jobs in the registry the queue
+// reads them from, like a StorageService does.
+type registeringQueue struct {
+	*JobPriorityQueue
+	jobs geanstalkd.JobRegistry
+}
+
+func (q registeringQueue) Push(j *geanstalkd.Job) error {
+	if err := q.JobPriorityQueue.Push(j); err != nil {
+		return err
+	}
+	return q.jobs.Insert(j)
+}
+
+func (q registeringQueue) Update(j *geanstalkd.Job) error {
+	if err := q.JobPriorityQueue.Update(j); err != nil {
+		return err
+	}
+	return q.jobs.Update(j)
+}
+
+func TestJobPriorityQueue(t *T) {
+	t.Parallel()
+
+	Convey("Given a fresh on-disk JobPriorityQueue", t, func() {
+		jobs := inmemory.NewBTreeJobRegistry(btree.New(2))
+		x := openTestQueueIndex(t, jobs, 0)
+		Reset(func() { x.Close() })
+
+		// Jobs of other queues in the same index must not be visible.
+		other := x.NewJobPriorityQueue()
+		for _, id := range []geanstalkd.JobID{1, 42, 1000} {
+			if err := other.Push(&geanstalkd.Job{ID: id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		testing.GenericJobPriorityQueueTest(registeringQueue{x.NewJobPriorityQueue(), jobs})
+	})
+}
+
+func TestStorageServiceWithJobPriorityQueue(t *T) {
+	t.Parallel()
+
+	Convey("Given a StorageService backed by on-disk JobPriorityQueues", t, func() {
+		r := openTestJobRegistry(t, 0)
+		x := openTestQueueIndex(t, r, 0)
+		Reset(func() {
+			x.Close()
+			r.Close()
+		})
+		testing.GenericStorageServiceTest(&geanstalkd.StorageService{
+			Jobs:                 r,
+			DelayTubes:           inmemory.NewTubeHeapPriorityQueue(),
+			NewJobPriorityQueue:  func() geanstalkd.JobPriorityQueue { return x.NewJobPriorityQueue() },
+			NewJobQueue:          func() geanstalkd.JobQueue { return inmemory.NewJobListQueue() },
+			NewTubePriorityQueue: func() geanstalkd.TubePriorityQueue { return inmemory.NewTubeHeapPriorityQueue() },
+		})
+	})
+}
+
+// TestJobPriorityQueueManyJobs uses a tiny cache and compares the queue with
+// a JobHeapPriorityQueue.
+func TestJobPriorityQueueManyJobs(t *T) {
+	t.Parallel()
+
+	jobs := inmemory.NewBTreeJobRegistry(btree.New(2))
+	x := openTestQueueIndex(t, jobs, 4)
+	defer x.Close()
+	q := x.NewJobPriorityQueue()
+	expected := inmemory.NewJobHeapPriorityQueue()
+
+	rnd := rand.New(rand.NewSource(1))
+	now := time.Now()
+	randomize := func(j *geanstalkd.Job) {
+		j.Priority = geanstalkd.Priority(rnd.Intn(10))
+		j.RunnableAt = nil
+		if rnd.Intn(2) == 0 {
+			at := now.Add(time.Duration(rnd.Int63n(int64(2*time.Hour))) - time.Hour)
+			j.RunnableAt = &at
+		}
+	}
+
+	for i := 0; i < 50000; i++ {
+		id := geanstalkd.JobID(rnd.Intn(10000) + 1)
+		j, err := jobs.GetByID(id)
+		exists := err == nil
+		switch op := rnd.Intn(10); {
+		case op < 4:
+			if exists {
+				if err := q.Push(j); err != geanstalkd.ErrJobAlreadyExist {
+					t.Fatal("Expected ErrJobAlreadyExist. Got:", err)
+				}
+				continue
+			}
+			j = &geanstalkd.Job{ID: id}
+			randomize(j)
+			if err := jobs.Insert(j); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.Push(j); err != nil {
+				t.Fatal("Could not push job:", err)
+			}
+			expected.Push(j)
+		case op < 6:
+			if !exists {
+				if err := q.Update(&geanstalkd.Job{ID: id}); err != geanstalkd.ErrJobMissing {
+					t.Fatal("Expected ErrJobMissing. Got:", err)
+				}
+				continue
+			}
+			randomize(j)
+			if err := q.Update(j); err != nil {
+				t.Fatal("Could not update job:", err)
+			}
+			expected.Update(j)
+		case op < 8:
+			err := q.RemoveByID(id)
+			if exists && err != nil || !exists && err != geanstalkd.ErrJobMissing {
+				t.Fatalf("Unexpected error removing job %d: %v", id, err)
+			}
+			if exists {
+				expected.RemoveByID(id)
+				jobs.DeleteByID(id)
+			}
+		default:
+			want, werr := expected.Pop()
+			got, err := q.Pop()
+			if err != werr || err == nil && got.ID != want.ID {
+				t.Fatalf("Expected to pop %v, %v. Got: %v, %v", want, werr, got, err)
+			}
+			if err == nil {
+				jobs.DeleteByID(got.ID)
+			}
+		}
+	}
+
+	for {
+		want, werr := expected.Pop()
+		got, err := q.Pop()
+		if err != werr || err == nil && got.ID != want.ID {
+			t.Fatalf("Expected to pop %v, %v. Got: %v, %v", want, werr, got, err)
+		}
+		if err != nil {
+			break
+		}
+	}
+}
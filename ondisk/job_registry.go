@@ -0,0 +1,125 @@
+package ondisk
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// jobRegistryMagic starts every JobRegistry file. Its last byte is the format
+// version.
+const jobRegistryMagic = "geanstalkd-jobs\x01"
+
+// DefaultCachePages is the number of pages cached in memory unless configured
+// otherwise.
+const DefaultCachePages = 1024
+
+// JobRegistry is a JobRegistry which stores jobs in a B+tree in a file. Every
+// call returns a new copy of the job, so changes to a job must be stored using
+// Update. Use OpenJobRegistry to create one.
+type JobRegistry struct {
+	lock sync.Mutex
+	tree *tree
+}
+
+// OpenJobRegistry opens a JobRegistry stored in a file, which is created if
+// it doesn't exist. At most cachePages pages of the tree are cached in
+// memory. Jobs are only guaranteed to be kept in the file if the registry is
+// closed using Close.
+func OpenJobRegistry(path string, cachePages int) (*JobRegistry, error) {
+	if cachePages <= 0 {
+		cachePages = DefaultCachePages
+	}
+	t, err := openTree(path, jobRegistryMagic, cachePages)
+	if err != nil {
+		return nil, err
+	}
+	return &JobRegistry{tree: t}, nil
+}
+
+// done evicts cached pages after an operation has finished. Returns err, or
+// the error evicting if err is nil.
+func (r *JobRegistry) done(err error) error {
+	if eerr := r.tree.evict(); err == nil {
+		err = eerr
+	}
+	return err
+}
+
+// Insert stores a new job. It returns geanstalkd.ErrJobAlreadyExist if a job
+// with the same ID already has been inserted.
+func (r *JobRegistry) Insert(j *geanstalkd.Job) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.tree.put(idKey(j.ID), encodeJob(j), putInsert)
+	if err == errKeyExists {
+		err = geanstalkd.ErrJobAlreadyExist
+	}
+	return r.done(err)
+}
+
+// Update replaces a previously inserted job. It returns
+// geanstalkd.ErrJobMissing if it can't find a job with the given ID.
+func (r *JobRegistry) Update(j *geanstalkd.Job) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.tree.put(idKey(j.ID), encodeJob(j), putReplace)
+	if err == errKeyMissing {
+		err = geanstalkd.ErrJobMissing
+	}
+	return r.done(err)
+}
+
+// GetByID returns a copy of the job with the given JobID. It returns
+// geanstalkd.ErrJobMissing if the job could not be found.
+func (r *JobRegistry) GetByID(id geanstalkd.JobID) (*geanstalkd.Job, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	b, err := r.tree.get(idKey(id))
+	if err == errKeyMissing {
+		return nil, r.done(geanstalkd.ErrJobMissing)
+	} else if err != nil {
+		return nil, r.done(err)
+	}
+	j, err := decodeJob(b)
+	return j, r.done(err)
+}
+
+// DeleteByID deletes a job. It returns geanstalkd.ErrJobMissing if the job
+// could not be found.
+func (r *JobRegistry) DeleteByID(id geanstalkd.JobID) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.tree.delete(idKey(id))
+	if err == errKeyMissing {
+		err = geanstalkd.ErrJobMissing
+	}
+	return r.done(err)
+}
+
+// GetLargestID returns the largest JobID of the stored jobs. It returns
+// geanstalkd.ErrEmptyRegistry if there are no jobs.
+func (r *JobRegistry) GetLargestID() (geanstalkd.JobID, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key, _, err := r.tree.first(true)
+	if err == errKeyMissing {
+		return 0, r.done(geanstalkd.ErrEmptyRegistry)
+	} else if err != nil {
+		return 0, r.done(err)
+	}
+	return geanstalkd.JobID(binary.BigEndian.Uint64(key)), r.done(nil)
+}
+
+// Close writes all cached changes and closes the file.
+func (r *JobRegistry) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.tree.close()
+}
@@ -0,0 +1,156 @@
+package ondisk
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	. "testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/JensRantil/geanstalkd"
+	"github.com/JensRantil/geanstalkd/inmemory"
+	"github.com/JensRantil/geanstalkd/testing"
+)
+
+func openTestJobRegistry(t *T, cachePages int) *JobRegistry {
+	r, err := OpenJobRegistry(filepath.Join(t.TempDir(), "jobs"), cachePages)
+	if err != nil {
+		t.Fatal("Could not open registry:", err)
+	}
+	return r
+}
+
+func TestJobRegistry(t *T) {
+	t.Parallel()
+
+	Convey("Given a fresh on-disk JobRegistry", t, func() {
+		r := openTestJobRegistry(t, 0)
+		Reset(func() { r.Close() })
+		testing.GenericJobRegistryTest(r)
+	})
+}
+
+func TestStorageServiceWithJobRegistry(t *T) {
+	t.Parallel()
+
+	Convey("Given a StorageService backed by an on-disk JobRegistry", t, func() {
+		r := openTestJobRegistry(t, 0)
+		Reset(func() { r.Close() })
+		testing.GenericStorageServiceTest(&geanstalkd.StorageService{
+			Jobs:                 r,
+			DelayTubes:           inmemory.NewTubeHeapPriorityQueue(),
+			NewJobPriorityQueue:  func() geanstalkd.JobPriorityQueue { return inmemory.NewJobHeapPriorityQueue() },
+			NewJobQueue:          func() geanstalkd.JobQueue { return inmemory.NewJobListQueue() },
+			NewTubePriorityQueue: func() geanstalkd.TubePriorityQueue { return inmemory.NewTubeHeapPriorityQueue() },
+		})
+	})
+}
+
+// TestJobRegistryManyJobs uses a tiny cache, so that most nodes have to be
+// read from the file, and compares the registry with a map.
+func TestJobRegistryManyJobs(t *T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "jobs")
+	r, err := OpenJobRegistry(path, 4)
+	if err != nil {
+		t.Fatal("Could not open registry:", err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	expected := make(map[geanstalkd.JobID]geanstalkd.Job)
+	for i := 0; i < 20000; i++ {
+		id := geanstalkd.JobID(rnd.Intn(5000) + 1)
+		_, exists := expected[id]
+		switch op := rnd.Intn(10); {
+		case op < 5:
+			// Some bodies need overflow pages.
+			body := make([]byte, rnd.Intn(3)*rnd.Intn(6000))
+			rnd.Read(body)
+			j := geanstalkd.Job{ID: id, Tube: "tube", Priority: geanstalkd.Priority(i), Body: body}
+			err := r.Insert(&j)
+			if exists && err != geanstalkd.ErrJobAlreadyExist || !exists && err != nil {
+				t.Fatalf("Unexpected error inserting job %d: %v", id, err)
+			}
+			if !exists {
+				expected[id] = j
+			}
+		case op < 7:
+			j := geanstalkd.Job{ID: id, Tube: "updated", Priority: geanstalkd.Priority(i), Body: []byte("updated")}
+			err := r.Update(&j)
+			if exists && err != nil || !exists && err != geanstalkd.ErrJobMissing {
+				t.Fatalf("Unexpected error updating job %d: %v", id, err)
+			}
+			if exists {
+				expected[id] = j
+			}
+		default:
+			err := r.DeleteByID(id)
+			if exists && err != nil || !exists && err != geanstalkd.ErrJobMissing {
+				t.Fatalf("Unexpected error deleting job %d: %v", id, err)
+			}
+			delete(expected, id)
+		}
+	}
+
+	verify := func(r *JobRegistry) {
+		var largest geanstalkd.JobID
+		for id := geanstalkd.JobID(1); id <= 5000; id++ {
+			want, exists := expected[id]
+			got, err := r.GetByID(id)
+			if !exists {
+				if err != geanstalkd.ErrJobMissing {
+					t.Fatalf("Expected job %d to be missing. Got: %v", id, err)
+				}
+				continue
+			}
+			largest = id
+			if err != nil {
+				t.Fatalf("Could not get job %d: %v", id, err)
+			}
+			if got.Tube != want.Tube || got.Priority != want.Priority || !bytes.Equal(got.Body, want.Body) {
+				t.Fatalf("Unexpected job %d: %+v", id, got)
+			}
+		}
+		if id, err := r.GetLargestID(); err != nil || id != largest {
+			t.Fatalf("Expected largest ID %d. Got: %d, %v", largest, id, err)
+		}
+	}
+	verify(r)
+
+	if err := r.Close(); err != nil {
+		t.Fatal("Could not close registry:", err)
+	}
+	r, err = OpenJobRegistry(path, 4)
+	if err != nil {
+		t.Fatal("Could not reopen registry:", err)
+	}
+	defer r.Close()
+	verify(r)
+
+	// Deleting all jobs leaves an empty tree.
+	for id := range expected {
+		if err := r.DeleteByID(id); err != nil {
+			t.Fatalf("Could not delete job %d: %v", id, err)
+		}
+	}
+	if _, err := r.GetLargestID(); err != geanstalkd.ErrEmptyRegistry {
+		t.Error("Expected ErrEmptyRegistry. Got:", err)
+	}
+}
+
+func TestOpenJobRegistryRejectsOtherFiles(t *T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "jobs")
+	other, err := openTree(path, "some other magic", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.close()
+
+	if _, err := OpenJobRegistry(path, 1); err != ErrBadFile {
+		t.Error("Expected ErrBadFile. Got:", err)
+	}
+}
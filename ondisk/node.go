@@ -0,0 +1,213 @@
+package ondisk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// maxKeySize is the largest key a tree can hold.
+const maxKeySize = 64
+
+// maxInlineSize is the largest value stored in a leaf. Larger values are
+// stored in overflow pages. Together with maxKeySize it guarantees that a leaf
+// split in two halves by size fits in two pages.
+const maxInlineSize = 512
+
+// value is the value of a key in a leaf. It is either stored inline, or in a
+// chain of overflow pages.
+type value struct {
+	inline   []byte
+	overflow pageID
+	length   uint32
+}
+
+// node is a decoded leaf or internal page of a tree.
+//
+// An internal node has one child more than it has keys. All keys in
+// children[i] are smaller than keys[i], which is smaller than or equal to all
+// keys in children[i+1]. Nodes are never merged, so both leaves and internal
+// nodes can have few keys. Leaves are never empty unless they are the root.
+type node struct {
+	id    pageID
+	leaf  bool
+	dirty bool
+
+	keys [][]byte
+	// values of a leaf.
+	values []value
+	// children of an internal node.
+	children []pageID
+}
+
+// search returns the index of the first key that is larger than or equal to
+// key.
+func (n *node) search(key []byte) int {
+	return sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) >= 0 })
+}
+
+// child returns the index of the child of an internal node which key belongs
+// to.
+func (n *node) child(key []byte) int {
+	return sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) > 0 })
+}
+
+func (v *value) size() int {
+	if v.overflow != 0 {
+		return 1 + 4 + 4
+	}
+	return 1 + 2 + len(v.inline)
+}
+
+func leafEntrySize(key []byte, v *value) int {
+	return 2 + len(key) + v.size()
+}
+
+// size returns the size of the encoded node.
+func (n *node) size() int {
+	size := 1 + 2
+	if n.leaf {
+		for i, key := range n.keys {
+			size += leafEntrySize(key, &n.values[i])
+		}
+		return size
+	}
+	size += 4
+	for _, key := range n.keys {
+		size += 2 + len(key) + 4
+	}
+	return size
+}
+
+func appendKey(b []byte, key []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(key)))
+	return append(b, key...)
+}
+
+// encode returns the page of the node.
+func (n *node) encode() []byte {
+	b := make([]byte, 0, pageSize)
+	if n.leaf {
+		b = append(b, pageLeaf)
+	} else {
+		b = append(b, pageInternal)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(n.keys)))
+
+	if n.leaf {
+		for i, key := range n.keys {
+			b = appendKey(b, key)
+			v := &n.values[i]
+			if v.overflow != 0 {
+				b = append(b, 1)
+				b = binary.BigEndian.AppendUint32(b, v.length)
+				b = binary.BigEndian.AppendUint32(b, uint32(v.overflow))
+			} else {
+				b = append(b, 0)
+				b = binary.BigEndian.AppendUint16(b, uint16(len(v.inline)))
+				b = append(b, v.inline...)
+			}
+		}
+		return b
+	}
+
+	b = binary.BigEndian.AppendUint32(b, uint32(n.children[0]))
+	for i, key := range n.keys {
+		b = appendKey(b, key)
+		b = binary.BigEndian.AppendUint32(b, uint32(n.children[i+1]))
+	}
+	return b
+}
+
+// pageReader reads the fields of a page. Reading past the end sets bad.
+type pageReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *pageReader) next(n int) []byte {
+	if r.bad || len(r.b) < n {
+		r.bad = true
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *pageReader) uint16() uint16 { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *pageReader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+
+func (r *pageReader) bytes(n int) []byte {
+	return append([]byte(nil), r.next(n)...)
+}
+
+// decodeNode decodes a page written by encode.
+func decodeNode(id pageID, page []byte) (*node, error) {
+	n := &node{id: id}
+	switch page[0] {
+	case pageLeaf:
+		n.leaf = true
+	case pageInternal:
+	default:
+		return nil, ErrBadFile
+	}
+
+	r := &pageReader{b: page[1:]}
+	count := int(r.uint16())
+	n.keys = make([][]byte, count)
+	if n.leaf {
+		n.values = make([]value, count)
+		for i := range n.keys {
+			n.keys[i] = r.bytes(int(r.uint16()))
+			if r.next(1)[0] == 1 {
+				n.values[i].length = r.uint32()
+				n.values[i].overflow = pageID(r.uint32())
+			} else {
+				n.values[i].inline = r.bytes(int(r.uint16()))
+			}
+		}
+	} else {
+		n.children = make([]pageID, count+1)
+		n.children[0] = pageID(r.uint32())
+		for i := range n.keys {
+			n.keys[i] = r.bytes(int(r.uint16()))
+			n.children[i+1] = pageID(r.uint32())
+		}
+	}
+	if r.bad {
+		return nil, ErrBadFile
+	}
+	return n, nil
+}
+
+// splitLeaf moves the upper half of a leaf, by size, to right.
+func (n *node) splitLeaf(right *node) {
+	half := n.size() / 2
+	size, i := 1+2, 0
+	for ; i < len(n.keys)-1; i++ {
+		size += leafEntrySize(n.keys[i], &n.values[i])
+		if size >= half {
+			i++
+			break
+		}
+	}
+
+	right.keys = append([][]byte(nil), n.keys[i:]...)
+	right.values = append([]value(nil), n.values[i:]...)
+	n.keys = n.keys[:i:i]
+	n.values = n.values[:i:i]
+}
+
+// splitInternal moves the upper half of an internal node to right. Returns
+// the key which separates them.
+func (n *node) splitInternal(right *node) []byte {
+	mid := len(n.keys) / 2
+	separator := n.keys[mid]
+
+	right.keys = append([][]byte(nil), n.keys[mid+1:]...)
+	right.children = append([]pageID(nil), n.children[mid+1:]...)
+	n.keys = n.keys[:mid:mid]
+	n.children = n.children[: mid+1 : mid+1]
+	return separator
+}
@@ -0,0 +1,207 @@
+// Package ondisk contains implementations of the interfaces in geanstalkd
+// which keep their data in files, so that they can hold more data than fits
+// in memory. Only a bounded number of pages are cached in memory.
+//
+// The files aren't crash safe. Use a binlog for durability.
+package ondisk
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrBadFile is returned when opening a file which wasn't written by this
+// package.
+var ErrBadFile = errors.New("not a file of a supported version")
+
+// pageSize is the size of every page in a file.
+const pageSize = 4096
+
+// pageID is the number of a page in a file. Page 0 holds the metadata of the
+// file, so 0 is used to refer to no page.
+type pageID uint32
+
+// The kinds of pages.
+const (
+	pageFree byte = iota + 1
+	pageLeaf
+	pageInternal
+	pageOverflow
+)
+
+// pager reads and writes the pages of a file and keeps track of free pages.
+// It isn't thread-safe.
+type pager struct {
+	file  *os.File
+	magic string
+
+	// pages is the number of pages in the file.
+	pages uint32
+	// free is the first page of a linked list of free pages.
+	free pageID
+	// root is a page to be stored in the metadata. It is used by the pager's
+	// user to find its data.
+	root pageID
+}
+
+// openPager opens a file of pages, which is created if it doesn't exist. The
+// file must start with magic, which identifies the kind of data in it.
+// Returns whether the file was created.
+func openPager(path, magic string) (*pager, bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, false, err
+	}
+	p := &pager{file: f, magic: magic}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	if info.Size() == 0 {
+		p.pages = 1
+		return p, true, p.writeMeta()
+	}
+
+	b := make([]byte, pageSize)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	if string(b[:len(magic)]) != magic {
+		f.Close()
+		return nil, false, ErrBadFile
+	}
+	b = b[len(magic):]
+	p.pages = binary.BigEndian.Uint32(b[0:])
+	p.free = pageID(binary.BigEndian.Uint32(b[4:]))
+	p.root = pageID(binary.BigEndian.Uint32(b[8:]))
+	return p, false, nil
+}
+
+func (p *pager) writeMeta() error {
+	b := make([]byte, pageSize)
+	n := copy(b, p.magic)
+	binary.BigEndian.PutUint32(b[n:], p.pages)
+	binary.BigEndian.PutUint32(b[n+4:], uint32(p.free))
+	binary.BigEndian.PutUint32(b[n+8:], uint32(p.root))
+	return p.write(0, b)
+}
+
+// read reads a page.
+func (p *pager) read(id pageID) ([]byte, error) {
+	b := make([]byte, pageSize)
+	if _, err := p.file.ReadAt(b, int64(id)*pageSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
+
+// write writes a page. b must be at most pageSize long.
+func (p *pager) write(id pageID, b []byte) error {
+	_, err := p.file.WriteAt(b, int64(id)*pageSize)
+	return err
+}
+
+// allocate returns a page which isn't used, reusing a free page if there is
+// one.
+func (p *pager) allocate() (pageID, error) {
+	if p.free == 0 {
+		id := pageID(p.pages)
+		p.pages++
+		return id, nil
+	}
+
+	id := p.free
+	b, err := p.read(id)
+	if err != nil {
+		return 0, err
+	}
+	p.free = pageID(binary.BigEndian.Uint32(b[1:]))
+	return id, nil
+}
+
+// release adds a page to the free pages.
+func (p *pager) release(id pageID) error {
+	b := make([]byte, 5)
+	b[0] = pageFree
+	binary.BigEndian.PutUint32(b[1:], uint32(p.free))
+	if err := p.write(id, b); err != nil {
+		return err
+	}
+	p.free = id
+	return nil
+}
+
+// overflowCapacity is the number of bytes stored in an overflow page.
+const overflowCapacity = pageSize - 7
+
+// writeOverflow stores b in a chain of overflow pages and returns the first
+// one.
+func (p *pager) writeOverflow(b []byte) (pageID, error) {
+	// Written back to front, so that every page knows the next one.
+	var next pageID
+	for end := len(b); end > 0; {
+		start := (end - 1) / overflowCapacity * overflowCapacity
+		id, err := p.allocate()
+		if err != nil {
+			return 0, err
+		}
+		page := make([]byte, 7, 7+end-start)
+		page[0] = pageOverflow
+		binary.BigEndian.PutUint32(page[1:], uint32(next))
+		binary.BigEndian.PutUint16(page[5:], uint16(end-start))
+		page = append(page, b[start:end]...)
+		if err := p.write(id, page); err != nil {
+			return 0, err
+		}
+		next, end = id, start
+	}
+	return next, nil
+}
+
+// readOverflow reads the data stored in a chain of overflow pages.
+func (p *pager) readOverflow(id pageID, length int) ([]byte, error) {
+	b := make([]byte, 0, length)
+	for id != 0 {
+		page, err := p.read(id)
+		if err != nil {
+			return nil, err
+		}
+		if page[0] != pageOverflow {
+			return nil, ErrBadFile
+		}
+		n := int(binary.BigEndian.Uint16(page[5:]))
+		b = append(b, page[7:7+n]...)
+		id = pageID(binary.BigEndian.Uint32(page[1:]))
+	}
+	return b, nil
+}
+
+// releaseOverflow frees a chain of overflow pages.
+func (p *pager) releaseOverflow(id pageID) error {
+	for id != 0 {
+		page, err := p.read(id)
+		if err != nil {
+			return err
+		}
+		next := pageID(binary.BigEndian.Uint32(page[1:]))
+		if err := p.release(id); err != nil {
+			return err
+		}
+		id = next
+	}
+	return nil
+}
+
+// close writes the metadata and closes the file.
+func (p *pager) close() error {
+	err := p.writeMeta()
+	if cerr := p.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
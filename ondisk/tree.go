@@ -0,0 +1,407 @@
+package ondisk
+
+import (
+	"container/list"
+	"errors"
+)
+
+var (
+	errKeyExists  = errors.New("key already exists")
+	errKeyMissing = errors.New("key is missing")
+)
+
+// putMode is whether tree.put may insert new keys and replace existing ones.
+type putMode int
+
+const (
+	putInsert putMode = iota
+	putReplace
+)
+
+// tree is a B+tree stored in the pages of a file. Keys are compared as byte
+// strings. Only a bounded number of nodes are cached in memory, as long as
+// evict is called after every operation. It isn't thread-safe.
+type tree struct {
+	pager *pager
+
+	// cache holds the most recently used nodes, ordered by use, with the most
+	// recent one at the front.
+	cache     map[pageID]*list.Element
+	lru       *list.List
+	cacheSize int
+}
+
+// openTree opens a tree stored in a file, which is created if it doesn't
+// exist. At most cacheSize nodes are cached in memory between operations.
+func openTree(path, magic string, cacheSize int) (*tree, error) {
+	p, created, err := openPager(path, magic)
+	if err != nil {
+		return nil, err
+	}
+	t := &tree{
+		pager:     p,
+		cache:     make(map[pageID]*list.Element),
+		lru:       list.New(),
+		cacheSize: cacheSize,
+	}
+
+	if created {
+		root, err := t.newNode(true)
+		if err != nil {
+			p.file.Close()
+			return nil, err
+		}
+		p.root = root.id
+	}
+	return t, nil
+}
+
+// node returns a node, reading it from the file unless it is cached.
+func (t *tree) node(id pageID) (*node, error) {
+	if e, ok := t.cache[id]; ok {
+		t.lru.MoveToFront(e)
+		return e.Value.(*node), nil
+	}
+
+	page, err := t.pager.read(id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := decodeNode(id, page)
+	if err != nil {
+		return nil, err
+	}
+	t.cache[id] = t.lru.PushFront(n)
+	return n, nil
+}
+
+// newNode allocates a page for a new, empty node.
+func (t *tree) newNode(leaf bool) (*node, error) {
+	id, err := t.pager.allocate()
+	if err != nil {
+		return nil, err
+	}
+	n := &node{id: id, leaf: leaf, dirty: true}
+	t.cache[id] = t.lru.PushFront(n)
+	return n, nil
+}
+
+// releaseNode frees the page of a node.
+func (t *tree) releaseNode(n *node) error {
+	if e, ok := t.cache[n.id]; ok {
+		t.lru.Remove(e)
+		delete(t.cache, n.id)
+	}
+	return t.pager.release(n.id)
+}
+
+// evict writes and drops the least recently used nodes until at most
+// cacheSize nodes are cached. It must only be called between operations,
+// since operations keep references to the nodes they modify.
+func (t *tree) evict() error {
+	for t.lru.Len() > t.cacheSize {
+		e := t.lru.Back()
+		n := e.Value.(*node)
+		if n.dirty {
+			if err := t.pager.write(n.id, n.encode()); err != nil {
+				return err
+			}
+		}
+		t.lru.Remove(e)
+		delete(t.cache, n.id)
+	}
+	return nil
+}
+
+// flush writes all modified nodes and the metadata.
+func (t *tree) flush() error {
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		n := e.Value.(*node)
+		if n.dirty {
+			if err := t.pager.write(n.id, n.encode()); err != nil {
+				return err
+			}
+			n.dirty = false
+		}
+	}
+	return t.pager.writeMeta()
+}
+
+func (t *tree) close() error {
+	err := t.flush()
+	if cerr := t.pager.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readValue returns the data of a value.
+func (t *tree) readValue(v *value) ([]byte, error) {
+	if v.overflow == 0 {
+		return v.inline, nil
+	}
+	return t.pager.readOverflow(v.overflow, int(v.length))
+}
+
+// get returns the value of a key. Returns errKeyMissing if there is none.
+func (t *tree) get(key []byte) ([]byte, error) {
+	n, err := t.node(t.pager.root)
+	for err == nil && !n.leaf {
+		n, err = t.node(n.children[n.child(key)])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	i := n.search(key)
+	if i == len(n.keys) || string(n.keys[i]) != string(key) {
+		return nil, errKeyMissing
+	}
+	return t.readValue(&n.values[i])
+}
+
+// first returns the smallest key and its value, or the largest one if last is
+// true. Returns errKeyMissing if the tree is empty.
+func (t *tree) first(last bool) ([]byte, []byte, error) {
+	n, err := t.node(t.pager.root)
+	for err == nil && !n.leaf {
+		i := 0
+		if last {
+			i = len(n.children) - 1
+		}
+		n, err = t.node(n.children[i])
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(n.keys) == 0 {
+		// Only the root leaf can be empty.
+		return nil, nil, errKeyMissing
+	}
+
+	i := 0
+	if last {
+		i = len(n.keys) - 1
+	}
+	data, err := t.readValue(&n.values[i])
+	return n.keys[i], data, err
+}
+
+// seek returns the smallest key which is equal to or larger than key, and its
+// value. Returns errKeyMissing if there is no such key.
+func (t *tree) seek(key []byte) ([]byte, []byte, error) {
+	root, err := t.node(t.pager.root)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t.seekIn(root, key)
+}
+
+func (t *tree) seekIn(n *node, key []byte) ([]byte, []byte, error) {
+	if n.leaf {
+		i := n.search(key)
+		if i == len(n.keys) {
+			return nil, nil, errKeyMissing
+		}
+		data, err := t.readValue(&n.values[i])
+		return n.keys[i], data, err
+	}
+
+	// The child key belongs to might only hold smaller keys, in which case
+	// the key is found in the next one.
+	for i := n.child(key); i < len(n.children); i++ {
+		child, err := t.node(n.children[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		k, data, err := t.seekIn(child, key)
+		if err != errKeyMissing {
+			return k, data, err
+		}
+	}
+	return nil, nil, errKeyMissing
+}
+
+// put stores the value of a key. Returns errKeyExists if the key exists and
+// mode is putInsert, and errKeyMissing if it doesn't and mode is putReplace.
+func (t *tree) put(key, data []byte, mode putMode) error {
+	if len(key) > maxKeySize {
+		return errors.New("key too large")
+	}
+	v := value{inline: data}
+	if len(data) > maxInlineSize {
+		id, err := t.pager.writeOverflow(data)
+		if err != nil {
+			return err
+		}
+		v = value{overflow: id, length: uint32(len(data))}
+	}
+
+	root, err := t.node(t.pager.root)
+	if err != nil {
+		return err
+	}
+	separator, right, err := t.putIn(root, key, v, mode)
+	if err != nil {
+		if v.overflow != 0 {
+			t.pager.releaseOverflow(v.overflow)
+		}
+		return err
+	}
+	if right == nil {
+		return nil
+	}
+
+	// The root was split.
+	newRoot, err := t.newNode(false)
+	if err != nil {
+		return err
+	}
+	newRoot.keys = [][]byte{separator}
+	newRoot.children = []pageID{root.id, right.id}
+	t.pager.root = newRoot.id
+	return nil
+}
+
+// putIn stores the value of a key in the subtree of n. If n had to be split,
+// the new right node and the key separating it from n is returned.
+func (t *tree) putIn(n *node, key []byte, v value, mode putMode) ([]byte, *node, error) {
+	if n.leaf {
+		i := n.search(key)
+		exists := i < len(n.keys) && string(n.keys[i]) == string(key)
+		switch {
+		case exists && mode == putInsert:
+			return nil, nil, errKeyExists
+		case !exists && mode == putReplace:
+			return nil, nil, errKeyMissing
+		case exists:
+			if old := n.values[i]; old.overflow != 0 {
+				if err := t.pager.releaseOverflow(old.overflow); err != nil {
+					return nil, nil, err
+				}
+			}
+			n.values[i] = v
+		default:
+			n.keys = append(n.keys, nil)
+			copy(n.keys[i+1:], n.keys[i:])
+			n.keys[i] = append([]byte(nil), key...)
+			n.values = append(n.values, value{})
+			copy(n.values[i+1:], n.values[i:])
+			n.values[i] = v
+		}
+		n.dirty = true
+
+		if n.size() <= pageSize {
+			return nil, nil, nil
+		}
+		right, err := t.newNode(true)
+		if err != nil {
+			return nil, nil, err
+		}
+		n.splitLeaf(right)
+		return right.keys[0], right, nil
+	}
+
+	i := n.child(key)
+	child, err := t.node(n.children[i])
+	if err != nil {
+		return nil, nil, err
+	}
+	separator, right, err := t.putIn(child, key, v, mode)
+	if err != nil || right == nil {
+		return nil, nil, err
+	}
+
+	n.keys = append(n.keys, nil)
+	copy(n.keys[i+1:], n.keys[i:])
+	n.keys[i] = separator
+	n.children = append(n.children, 0)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = right.id
+	n.dirty = true
+
+	if n.size() <= pageSize {
+		return nil, nil, nil
+	}
+	newRight, err := t.newNode(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return n.splitInternal(newRight), newRight, nil
+}
+
+// delete removes a key. Returns errKeyMissing if it doesn't exist.
+func (t *tree) delete(key []byte) error {
+	root, err := t.node(t.pager.root)
+	if err != nil {
+		return err
+	}
+	if _, err := t.deleteIn(root, key); err != nil {
+		return err
+	}
+
+	// Shrink the tree while the root has a single child.
+	for !root.leaf && len(root.children) <= 1 {
+		if len(root.children) == 0 {
+			root.leaf, root.dirty = true, true
+			root.keys, root.children = nil, nil
+			break
+		}
+		child, err := t.node(root.children[0])
+		if err != nil {
+			return err
+		}
+		if err := t.releaseNode(root); err != nil {
+			return err
+		}
+		root = child
+		t.pager.root = root.id
+	}
+	return nil
+}
+
+// deleteIn removes a key from the subtree of n. Returns true if n is empty
+// afterwards and has to be removed by its parent.
+func (t *tree) deleteIn(n *node, key []byte) (bool, error) {
+	if n.leaf {
+		i := n.search(key)
+		if i == len(n.keys) || string(n.keys[i]) != string(key) {
+			return false, errKeyMissing
+		}
+		if v := n.values[i]; v.overflow != 0 {
+			if err := t.pager.releaseOverflow(v.overflow); err != nil {
+				return false, err
+			}
+		}
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.values = append(n.values[:i], n.values[i+1:]...)
+		n.dirty = true
+		return len(n.keys) == 0, nil
+	}
+
+	i := n.child(key)
+	child, err := t.node(n.children[i])
+	if err != nil {
+		return false, err
+	}
+	empty, err := t.deleteIn(child, key)
+	if err != nil || !empty {
+		return false, err
+	}
+
+	// Keys which belonged to the removed child now belong to one of its
+	// siblings.
+	if err := t.releaseNode(child); err != nil {
+		return false, err
+	}
+	n.children = append(n.children[:i], n.children[i+1:]...)
+	if len(n.keys) > 0 {
+		k := i - 1
+		if k < 0 {
+			k = 0
+		}
+		n.keys = append(n.keys[:k], n.keys[k+1:]...)
+	}
+	n.dirty = true
+	return len(n.children) == 0, nil
+}
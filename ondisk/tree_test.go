@@ -0,0 +1,86 @@
+package ondisk
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"path/filepath"
+	. "testing"
+)
+
+// TestTreeDeep grows a tree with several levels of internal nodes and then
+// shrinks it again.
+func TestTreeDeep(t *T) {
+	t.Parallel()
+
+	tr, err := openTree(filepath.Join(t.TempDir(), "tree"), "test", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.close()
+
+	const count = 100000
+	key := func(i int) []byte { return binary.BigEndian.AppendUint64(nil, uint64(i)) }
+	for _, i := range rand.New(rand.NewSource(1)).Perm(count) {
+		if err := tr.put(key(i), key(i), putInsert); err != nil {
+			t.Fatal("Could not put key:", err)
+		}
+		if err := tr.evict(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if levels := treeLevels(t, tr); levels < 3 {
+		t.Fatal("Expected at least three levels. Got:", levels)
+	}
+
+	deleted := make(map[int]bool)
+	for n, i := range rand.New(rand.NewSource(2)).Perm(count) {
+		if err := tr.delete(key(i)); err != nil {
+			t.Fatal("Could not delete key:", err)
+		}
+		if err := tr.evict(); err != nil {
+			t.Fatal(err)
+		}
+		deleted[i] = true
+
+		if n%1000 != 0 || n == count-1 {
+			continue
+		}
+		smallest, largest := 0, count-1
+		for deleted[smallest] {
+			smallest++
+		}
+		for deleted[largest] {
+			largest--
+		}
+		if first, _, err := tr.first(false); err != nil || binary.BigEndian.Uint64(first) != uint64(smallest) {
+			t.Fatalf("Expected smallest key %d. Got: %v, %v", smallest, first, err)
+		}
+		if last, value, err := tr.first(true); err != nil || binary.BigEndian.Uint64(last) != uint64(largest) ||
+			binary.BigEndian.Uint64(value) != uint64(largest) {
+			t.Fatalf("Expected largest key %d. Got: %v, %v", largest, last, err)
+		}
+	}
+
+	if _, _, err := tr.first(false); err != errKeyMissing {
+		t.Error("Expected an empty tree. Got:", err)
+	}
+	if levels := treeLevels(t, tr); levels != 1 {
+		t.Error("Expected the tree to shrink to a single leaf. Got levels:", levels)
+	}
+	if tr.pager.free == 0 {
+		t.Error("Expected the pages of removed nodes to be freed.")
+	}
+}
+
+func treeLevels(t *T, tr *tree) int {
+	levels := 1
+	n, err := tr.node(tr.pager.root)
+	for err == nil && !n.leaf {
+		levels++
+		n, err = tr.node(n.children[0])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return levels
+}
@@ -1,46 +1,341 @@
 package geanstalkd
 
 import (
+	"context"
 	"errors"
+	"io"
 	"sync"
 	"time"
-	//"context"
 )
 
 // Common `Server` errors.
 var (
 	ErrDraining = errors.New("server is draining. No new jobs can be added")
+
+	// ErrDeadlineSoon is returned when a client is waiting for a job while one
+	// of its reserved jobs is about to time out.
+	ErrDeadlineSoon = errors.New("a reserved job is about to time out")
 )
 
+// MinTimeToRun is the smallest time-to-run a job can have. Like beanstalkd, a
+// smaller time-to-run is silently increased to this.
+const MinTimeToRun = time.Second
+
 // Server is the facade through which all interactions to geanstalk go from the
 // net layer.
 type Server struct {
-	Storage *LockService
+	Storage    *LockService
+	TTR        TTRService
+	Delay      DelayService
+	Statistics StatisticsService
+	// MaxJobSize is the largest job body accepted. DefaultMaxJobSize is used
+	// if it's zero.
+	MaxJobSize int
+	// Memory limits the size of job bodies being received. It should be the
+	// MemoryBudget of the StorageService. May be nil.
+	Memory *MemoryBudget
 
 	// TODO: Investigate if a sync.RWMutex will be useful.
 	Ids <-chan (JobID)
 
-	lock sync.Mutex
+	lock     sync.Mutex
+	draining bool
+}
+
+// drainedPollInterval is how often WaitDrained checks whether all jobs are
+// gone.
+const drainedPollInterval = 100 * time.Millisecond
+
+// SetDraining sets whether the server is draining. A draining server rejects
+// new jobs with ErrDraining, while existing jobs still can be reserved,
+// released and deleted.
+func (s *Server) SetDraining(draining bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.draining = draining
 }
 
-// BuildJob constructs a new job with an ID unique to this Server.
-func (s *Server) BuildJob(pri Priority, at time.Time, ttr time.Duration, jobdata []byte) Job {
+// Draining returns whether the server is draining.
+func (s *Server) Draining() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.draining
+}
+
+// WaitDrained blocks until the server is draining and holds no jobs, or until
+// ctx is done, in which case ctx.Err() is returned.
+func (s *Server) WaitDrained(ctx context.Context) error {
+	ticker := time.NewTicker(drainedPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.Draining() {
+			stats := s.Stats()
+			if stats.ReadyJobs+stats.ReservedJobs+stats.DelayedJobs+stats.BuriedJobs == 0 {
+				return nil
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// JobSizeLimit returns the largest job body accepted.
+func (s *Server) JobSizeLimit() int {
+	if s.MaxJobSize == 0 {
+		return DefaultMaxJobSize
+	}
+	return s.MaxJobSize
+}
+
+// BuildJob constructs a new job in a tube with an ID unique to this Server.
+// The job becomes runnable after delay.
+func (s *Server) BuildJob(tube Tube, pri Priority, delay time.Duration, ttr time.Duration, jobdata []byte) Job {
+	if ttr < MinTimeToRun {
+		ttr = MinTimeToRun
+	}
+	now := time.Now()
+	at := now.Add(delay)
 	return Job{
 		ID:         <-s.Ids,
+		Tube:       tube,
 		RunnableAt: &at,
 		TimeToRun:  ttr,
 		Body:       jobdata,
 		Priority:   pri,
+		CreatedAt:  now,
+		Delay:      delay,
 	}
 }
 
-// Add adds a new job to this Server.
+// Add adds a new job to this Server. Returns ErrDraining if the server is
+// draining.
 func (s *Server) Add(j *Job) error {
-	// TODO: Delegate to `DelayService` if job is delayed.
-	return s.Storage.Add(j)
+	if s.Draining() {
+		return ErrDraining
+	}
+
+	var delayedUntil *time.Time
+	if j.RunnableAt != nil && j.RunnableAt.After(time.Now()) {
+		delayedUntil = j.RunnableAt
+	}
+
+	// Spilled before taking the storage lock, since writing a large body is
+	// slow.
+	if err := s.Storage.Spill(j); err != nil {
+		return err
+	}
+	if err := s.Storage.Add(j); err != nil {
+		return err
+	}
+
+	if delayedUntil != nil {
+		s.Delay.Schedule(*delayedUntil)
+	}
+	return nil
+}
+
+// DeleteByID deletes a job with the given ID from this Server on behalf of
+// client. Jobs reserved by other clients can't be deleted.
+func (s *Server) DeleteByID(client ClientID, id JobID) error {
+	if err := s.Storage.DeleteByID(client, id); err != nil {
+		return err
+	}
+	s.TTR.Delete(client, id)
+	return nil
+}
+
+// Release puts a job reserved by client back in the ready queue with a new
+// priority. If delay is positive, the job is delayed instead.
+func (s *Server) Release(client ClientID, id JobID, pri Priority, delay time.Duration) error {
+	if err := s.Storage.Release(client, id, pri, delay); err != nil {
+		return err
+	}
+	s.TTR.Delete(client, id)
+
+	if delay > 0 {
+		// Not earlier than the job's RunnableAt, so the job will be promoted.
+		s.Delay.Schedule(time.Now().Add(delay))
+	}
+	return nil
+}
+
+// ReleaseAll puts all jobs reserved by client back in the ready queue with
+// their current priority. It is used when a client disconnects, so like
+// beanstalkd it doesn't count the jobs as released.
+func (s *Server) ReleaseAll(client ClientID) error {
+	var firstErr error
+	for _, id := range s.TTR.Reserved(client) {
+		// Jobs deleted or timed out after being listed are left alone.
+		if err := s.Storage.Unreserve(client, id); err == nil {
+			s.TTR.Delete(client, id)
+		} else if err != ErrJobMissing && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Touch gives a job reserved by client its full time-to-run again. Returns
+// ErrJobMissing if the job isn't reserved by client.
+func (s *Server) Touch(client ClientID, id JobID) error {
+	return s.TTR.Touch(client, id)
+}
+
+// Bury buries a job reserved by client with a new priority. Buried jobs are
+// never reserved until they are kicked.
+func (s *Server) Bury(client ClientID, id JobID, pri Priority) error {
+	if err := s.Storage.Bury(client, id, pri); err != nil {
+		return err
+	}
+	s.TTR.Delete(client, id)
+	return nil
+}
+
+// Kick moves at most bound jobs in a tube to its ready queue. Buried jobs are
+// kicked if there are any, otherwise delayed jobs are kicked. Returns the
+// number of jobs kicked.
+func (s *Server) Kick(tube Tube, bound int) (int, error) {
+	return s.Storage.Kick(tube, bound)
 }
 
-// DeleteByID deletes a job with the given ID from this Server.
-func (s *Server) DeleteByID(id JobID) error {
-	return s.Storage.DeleteByID(id)
+// KickJob moves a single buried or delayed job to the ready queue.
+func (s *Server) KickJob(id JobID) error {
+	return s.Storage.KickJob(id)
+}
+
+// ReserveJob reserves a ready, delayed or buried job by ID on behalf of
+// client, regardless of its position in its queue.
+func (s *Server) ReserveJob(client ClientID, id JobID) (*Job, error) {
+	job, err := s.Storage.ReserveByID(client, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.TTR.Reserve(client, *job)
+	return job, nil
+}
+
+// Peek returns the job with the given ID without reserving it.
+func (s *Server) Peek(id JobID) (*Job, error) {
+	return s.Storage.Read(id)
+}
+
+// PeekReady returns the next ready job in a tube without reserving it.
+func (s *Server) PeekReady(tube Tube) (*Job, error) {
+	return s.Storage.PeekReady(tube)
+}
+
+// PeekDelayed returns the next delayed job in a tube.
+func (s *Server) PeekDelayed(tube Tube) (*Job, error) {
+	return s.Storage.PeekDelayed(tube)
+}
+
+// PeekBuried returns the next buried job in a tube.
+func (s *Server) PeekBuried(tube Tube) (*Job, error) {
+	return s.Storage.PeekBuried(tube)
+}
+
+// OpenBody returns a reader of the body of a job, whether it's in memory or
+// spilled out of it. Returns ErrJobMissing if the job has been deleted. The
+// reader must be closed.
+func (s *Server) OpenBody(j *Job) (io.ReadCloser, error) {
+	return s.Storage.OpenBody(j)
+}
+
+// TimeLeft returns the time until a reserved job times out or until a delayed
+// job becomes ready. Returns zero for jobs in other states.
+func (s *Server) TimeLeft(j *Job) time.Duration {
+	var left time.Duration
+	switch j.State {
+	case StateReserved:
+		if deadline, ok := s.TTR.Deadline(j.ID); ok {
+			left = time.Until(deadline)
+		}
+	case StateDelayed:
+		if j.RunnableAt != nil {
+			left = time.Until(*j.RunnableAt)
+		}
+	}
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// Use registers that a client puts jobs in a tube. It must be followed by a
+// call to Unuse when the tube no longer is used.
+func (s *Server) Use(tube Tube) {
+	s.Storage.Use(tube)
+}
+
+// Unuse registers that a client no longer puts jobs in a tube.
+func (s *Server) Unuse(tube Tube) {
+	s.Storage.Unuse(tube)
+}
+
+// Tubes returns the names of all existing tubes.
+func (s *Server) Tubes() []Tube {
+	return s.Storage.Tubes()
+}
+
+// TubeStats returns the statistics of a tube. Returns ErrTubeMissing if the
+// tube doesn't exist.
+func (s *Server) TubeStats(tube Tube) (TubeStats, error) {
+	return s.Storage.TubeStats(tube)
+}
+
+// PauseTube keeps jobs in a tube from being reserved for a duration. Returns
+// ErrTubeMissing if the tube doesn't exist.
+func (s *Server) PauseTube(tube Tube, pause time.Duration) error {
+	if err := s.Storage.PauseTube(tube, pause); err != nil {
+		return err
+	}
+	// Not earlier than the tube is resumed.
+	s.Delay.Schedule(time.Now().Add(pause))
+	return nil
+}
+
+// Stats returns the server-wide statistics of the storage.
+func (s *Server) Stats() StorageStats {
+	return s.Storage.Stats()
+}
+
+// Watch returns the WatchSet for a list of tubes. It must be released using
+// Unwatch when no longer used.
+func (s *Server) Watch(tubes []Tube) *WatchSet {
+	return s.Storage.Watch(tubes)
+}
+
+// Unwatch releases a WatchSet previously returned by Watch.
+func (s *Server) Unwatch(ws *WatchSet) {
+	s.Storage.Unwatch(ws)
+}
+
+// Reserve reserves the next ready job in a watch set on behalf of client. If
+// there is no job available it blocks until one becomes available or until
+// ctx is done, in which case ctx.Err() is returned. If one of the client's reserved jobs is
+// about to time out while waiting, ErrDeadlineSoon is returned.
+func (s *Server) Reserve(ctx context.Context, client ClientID, ws *WatchSet) (*Job, error) {
+	pollCtx := ctx
+	if deadline, ok := s.TTR.NextDeadline(client); ok {
+		var cancel context.CancelFunc
+		pollCtx, cancel = context.WithDeadline(ctx, deadline.Add(-DeadlineSoonMargin))
+		defer cancel()
+	}
+
+	job, err := s.Storage.Poll(pollCtx, client, ws)
+	if err != nil {
+		if ctx.Err() == nil && pollCtx.Err() != nil {
+			return nil, ErrDeadlineSoon
+		}
+		return nil, err
+	}
+
+	s.TTR.Reserve(client, *job)
+	return job, nil
 }
@@ -0,0 +1,49 @@
+package geanstalkd_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/btree"
+
+	"github.com/JensRantil/geanstalkd"
+	"github.com/JensRantil/geanstalkd/inmemory"
+
+	. "testing"
+)
+
+var defaultTubes = []geanstalkd.Tube{geanstalkd.DefaultTube}
+
+func newTestServer(ctx context.Context) *geanstalkd.Server {
+	stats := geanstalkd.NewMapStatisticsService()
+	storage := geanstalkd.NewLockService(
+		&geanstalkd.StorageService{
+			Jobs:                 inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize)),
+			DelayTubes:           inmemory.NewTubeHeapPriorityQueue(),
+			NewJobPriorityQueue:  func() geanstalkd.JobPriorityQueue { return inmemory.NewJobHeapPriorityQueue() },
+			NewJobQueue:          func() geanstalkd.JobQueue { return inmemory.NewJobListQueue() },
+			NewTubePriorityQueue: func() geanstalkd.TubePriorityQueue { return inmemory.NewTubeHeapPriorityQueue() },
+			Statistics:           stats,
+		},
+	)
+	return &geanstalkd.Server{
+		Storage:    storage,
+		TTR:        geanstalkd.NewHeapTTRService(storage),
+		Delay:      geanstalkd.NewPollingDelayService(storage),
+		Statistics: stats,
+		Ids:        geanstalkd.GenerateIds(ctx),
+	}
+}
+
+func closeTestServer(srv *geanstalkd.Server) {
+	srv.TTR.Close()
+	srv.Delay.Close()
+}
+
+func addTestJob(t *T, srv *geanstalkd.Server, delay, ttr time.Duration) geanstalkd.Job {
+	job := srv.BuildJob(geanstalkd.DefaultTube, 0, delay, ttr, []byte("hello"))
+	if err := srv.Add(&job); err != nil {
+		t.Fatal("Could not add job:", err)
+	}
+	return job
+}
@@ -1,6 +1,9 @@
 package geanstalkd
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 // Service is the generic interface for all services that are closeable.
 type Service interface {
@@ -12,13 +15,31 @@ type Service interface {
 type TTRService interface {
 	Service
 
-	Reserve(Job)
-	Delete(Job)
-	Touch(Job)
+	// Reserve starts tracking a job reserved by a client.
+	Reserve(ClientID, Job)
+
+	// Delete stops tracking a job reserved by a client. Jobs reserved by other
+	// clients are left untouched.
+	Delete(ClientID, JobID)
+
+	// Touch resets the deadline of a job reserved by a client. Returns
+	// `ErrJobMissing` if the job isn't reserved by the client.
+	Touch(ClientID, JobID) error
+
+	// NextDeadline returns the earliest deadline among the jobs reserved by a
+	// client. Returns false if the client has no reserved jobs.
+	NextDeadline(ClientID) (time.Time, bool)
+
+	// Reserved returns the jobs reserved by a client.
+	Reserved(ClientID) []JobID
+
+	// Deadline returns when a reserved job times out. Returns false if the
+	// job isn't tracked.
+	Deadline(JobID) (time.Time, bool)
 }
 
 // DelayService converts delayed jobs to READY state when their delayed has
-// passed.
+// passed, and resumes paused tubes when their pause has passed.
 //
 // Two possible implementations of this:
 //  - One in-memory. Probably using a heap or something.
@@ -28,8 +49,23 @@ type TTRService interface {
 // Uses `LockService` and `StatisticsService`.
 type DelayService interface {
 	Service
+
+	// Schedule notifies the service that a delayed job becomes runnable, or a
+	// paused tube is resumed, at the given time.
+	Schedule(time.Time)
 }
 
-// StatisticsService keeps track of statistics.
+// StatisticsService keeps track of server-wide statistics. Must be
+// thread-safe.
 type StatisticsService interface {
+	Service
+
+	// Add adds a delta to a counter.
+	Add(Counter, int64)
+
+	// Get returns the value of a counter. Counters never added to are zero.
+	Get(Counter) int64
+
+	// Uptime returns for how long statistics have been kept.
+	Uptime() time.Duration
 }
@@ -10,7 +10,9 @@ package geanstalkd
 func Less(left, right Job) bool {
 	if a, b := left.RunnableAt, right.RunnableAt; a != nil || b != nil {
 		if a != nil && b != nil {
-			return a.Before(*b)
+			if !a.Equal(*b) {
+				return a.Before(*b)
+			}
 		} else if a != nil {
 			return true
 		} else /*if b != nil*/ {
@@ -18,13 +20,9 @@ func Less(left, right Job) bool {
 		}
 	}
 
-	if left.Priority < right.Priority {
-		return true
+	if left.Priority != right.Priority {
+		return left.Priority < right.Priority
 	}
 
-	if left.ID < right.ID {
-		return true
-	}
-
-	return false
+	return left.ID < right.ID
 }
@@ -0,0 +1,77 @@
+package geanstalkd
+
+import (
+	"sync"
+	"time"
+)
+
+// Counter is the name of a server-wide counter, as reported by the stats
+// command.
+type Counter string
+
+// Counters which aren't counting commands.
+const (
+	CounterJobTimeouts        Counter = "job-timeouts"
+	CounterTotalJobs          Counter = "total-jobs"
+	CounterCurrentConnections Counter = "current-connections"
+	CounterCurrentProducers   Counter = "current-producers"
+	CounterCurrentWorkers     Counter = "current-workers"
+	CounterTotalConnections   Counter = "total-connections"
+
+	CounterBinlogOldestIndex     Counter = "binlog-oldest-index"
+	CounterBinlogCurrentIndex    Counter = "binlog-current-index"
+	CounterBinlogRecordsMigrated Counter = "binlog-records-migrated"
+	CounterBinlogRecordsWritten  Counter = "binlog-records-written"
+	CounterBinlogMaxSize         Counter = "binlog-max-size"
+	CounterBinlogFsyncs          Counter = "binlog-fsyncs"
+	// CounterBinlogFsyncNanos is the total time spent in fsync.
+	CounterBinlogFsyncNanos Counter = "binlog-fsync-nanos"
+)
+
+// CommandCounter returns the Counter of how many times a protocol command has
+// been issued.
+func CommandCounter(cmd string) Counter {
+	return Counter("cmd-" + cmd)
+}
+
+// MapStatisticsService is an in-memory StatisticsService backed by a map. Use
+// NewMapStatisticsService to create one.
+type MapStatisticsService struct {
+	started time.Time
+
+	lock     sync.Mutex
+	counters map[Counter]int64
+}
+
+// NewMapStatisticsService creates a new MapStatisticsService. Its uptime
+// starts now.
+func NewMapStatisticsService() *MapStatisticsService {
+	return &MapStatisticsService{
+		started:  time.Now(),
+		counters: make(map[Counter]int64),
+	}
+}
+
+// Add adds a delta to a counter.
+func (m *MapStatisticsService) Add(c Counter, delta int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.counters[c] += delta
+}
+
+// Get returns the value of a counter.
+func (m *MapStatisticsService) Get(c Counter) int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.counters[c]
+}
+
+// Uptime returns the time since the MapStatisticsService was created.
+func (m *MapStatisticsService) Uptime() time.Duration {
+	return time.Since(m.started)
+}
+
+// Close does nothing.
+func (m *MapStatisticsService) Close() error {
+	return nil
+}
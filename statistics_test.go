@@ -0,0 +1,37 @@
+package geanstalkd_test
+
+import (
+	"sync"
+
+	"github.com/JensRantil/geanstalkd"
+
+	. "testing"
+)
+
+func TestMapStatisticsServiceCounters(t *T) {
+	t.Parallel()
+
+	stats := geanstalkd.NewMapStatisticsService()
+	defer stats.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats.Add(geanstalkd.CommandCounter("put"), 2)
+			stats.Add(geanstalkd.CounterCurrentConnections, -1)
+		}()
+	}
+	wg.Wait()
+
+	if put := stats.Get(geanstalkd.CommandCounter("put")); put != 20 {
+		t.Error("Unexpected cmd-put:", put)
+	}
+	if conns := stats.Get(geanstalkd.CounterCurrentConnections); conns != -10 {
+		t.Error("Unexpected current-connections:", conns)
+	}
+	if timeouts := stats.Get(geanstalkd.CounterJobTimeouts); timeouts != 0 {
+		t.Error("Expected untouched counter to be zero. Got:", timeouts)
+	}
+}
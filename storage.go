@@ -1,7 +1,11 @@
 package geanstalkd
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -10,78 +14,670 @@ var (
 	ErrNoJobReady = errors.New("no job ready")
 	// ErrNoJobDelayed is returned when there is no delayed job ready.
 	ErrNoJobDelayed = errors.New("no delayed job ready")
+	// ErrNoJobBuried is returned when there is no buried job.
+	ErrNoJobBuried = errors.New("no job buried")
+	// ErrReservedByOtherClient is returned when a client tries to modify a job
+	// reserved by another client.
+	ErrReservedByOtherClient = errors.New("job is reserved by another client")
 )
 
+// WatchSet is a set of tubes that a client reserves jobs from. Its
+// TubePriorityQueue orders the ready queues of the tubes, which makes finding
+// the next job independent of the number of tubes watched. Clients watching
+// the same tubes share a WatchSet. Use StorageService.Watch to create one.
+type WatchSet struct {
+	key   string
+	tubes []Tube
+	ready TubePriorityQueue
+	refs  int
+
+	// waiting is the number of clients waiting for a job in the watch set.
+	waiting int
+}
+
+// Tubes returns the tubes in the watch set, sorted by name.
+func (ws *WatchSet) Tubes() []Tube {
+	return ws.tubes
+}
+
 // StorageService stores jobs. All operations are atomic in terms of storage.
 // Calls to all of its functions are non-blocking.
+//
+// Every tube has its own ready, delay and buried queues. They are created on
+// demand using NewJobPriorityQueue and NewJobQueue, and removed when the tube
+// no longer is used, watched or holds any jobs. Watch sets are created using
+// NewTubePriorityQueue.
 type StorageService struct {
-	Jobs       JobRegistry
-	ReadyQueue JobPriorityQueue
-	DelayQueue JobPriorityQueue
+	Jobs JobRegistry
+
+	// DelayTubes orders the delay queues of all tubes by their next delayed
+	// job.
+	DelayTubes TubePriorityQueue
+
+	NewJobPriorityQueue  func() JobPriorityQueue
+	NewJobQueue          func() JobQueue
+	NewTubePriorityQueue func() TubePriorityQueue
+
+	// Statistics is told about created and timed out jobs. May be nil.
+	Statistics StatisticsService
+	// Memory is told about the bodies of stored jobs which Jobs keeps in
+	// memory. May be nil.
+	Memory *MemoryBudget
+	// Bodies keeps the bodies of at least SpillSize bytes out of memory. May
+	// be nil. Jobs must drop spilled bodies, see SpillingJobRegistry.
+	Bodies    BodyStore
+	SpillSize int
+
+	tubes     map[Tube]*tubeQueues
+	paused    map[Tube]*tubeQueues
+	watchSets map[string]*WatchSet
+}
+
+// report adds a delta to a counter of the StatisticsService, if there is one.
+func (s *StorageService) report(c Counter, delta int64) {
+	if s.Statistics != nil {
+		s.Statistics.Add(c, delta)
+	}
+}
+
+// Watch returns the WatchSet for a list of tubes. Every call to Watch must be
+// followed by a call to Unwatch when the WatchSet no longer is used.
+func (s *StorageService) Watch(tubes []Tube) *WatchSet {
+	unique := make(map[Tube]struct{}, len(tubes))
+	sorted := make([]Tube, 0, len(tubes))
+	names := make([]string, 0, len(tubes))
+	for _, tube := range tubes {
+		if _, seen := unique[tube]; !seen {
+			unique[tube] = struct{}{}
+			sorted = append(sorted, tube)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, tube := range sorted {
+		names = append(names, string(tube))
+	}
+	// Tube names can't contain spaces.
+	key := strings.Join(names, " ")
+
+	if s.watchSets == nil {
+		s.watchSets = make(map[string]*WatchSet)
+	}
+	if ws, ok := s.watchSets[key]; ok {
+		ws.refs++
+		return ws
+	}
+
+	ws := &WatchSet{
+		key:   key,
+		tubes: sorted,
+		ready: s.NewTubePriorityQueue(),
+		refs:  1,
+	}
+	for _, tube := range sorted {
+		q := s.queues(tube)
+		if !q.paused() {
+			ws.ready.Push(tube, q.ready)
+		}
+		q.watchers[ws] = struct{}{}
+	}
+	s.watchSets[key] = ws
+	return ws
+}
+
+// Unwatch releases a WatchSet previously returned by Watch.
+func (s *StorageService) Unwatch(ws *WatchSet) {
+	ws.refs--
+	if ws.refs > 0 {
+		return
+	}
+
+	delete(s.watchSets, ws.key)
+	for _, tube := range ws.tubes {
+		delete(s.queues(tube).watchers, ws)
+		s.removeIfUnused(tube)
+	}
+}
+
+// fixReady must be called every time the ready queue of a tube has changed.
+func (s *StorageService) fixReady(tube Tube) {
+	q := s.queues(tube)
+	if q.paused() {
+		return
+	}
+	for ws := range q.watchers {
+		ws.ready.FixByTube(tube)
+	}
+}
+
+// pushReady adds a job to the ready queue of its tube.
+func (s *StorageService) pushReady(j *Job) error {
+	if err := s.queues(j.Tube).ready.Push(j); err != nil {
+		return err
+	}
+	s.fixReady(j.Tube)
+	return nil
 }
 
 // Add adds a new job to the storage service. Returns ErrJobAlreadyExist if a
 // job with the given ID has already been added.
+//
+// Jobs that are runnable are added to the ready queue of their tube in
+// StateReady and have their RunnableAt cleared, so that ready jobs are ordered
+// by priority. Other jobs are added to the delay queue in StateDelayed.
 func (s *StorageService) Add(j *Job) error {
-	if err := s.Jobs.Insert(j); err != nil {
+	if err := s.insert(j); err != nil {
 		return err
 	}
-	if j.RunnableAt != nil && time.Now().After(*j.RunnableAt) {
-		s.ReadyQueue.Push(j)
+	s.queues(j.Tube).totalJobs++
+	s.report(CounterTotalJobs, 1)
+	return nil
+}
+
+// insert adds a job to the ready or delay queue, depending on its RunnableAt.
+func (s *StorageService) insert(j *Job) error {
+	if j.RunnableAt != nil && !j.RunnableAt.After(time.Now()) {
+		j.RunnableAt = nil
+	}
+	if j.RunnableAt == nil {
+		j.State = StateReady
 	} else {
-		s.DelayQueue.Push(j)
+		j.State = StateDelayed
+	}
+	if err := s.store(j); err != nil {
+		return err
+	}
+	s.queues(j.Tube).count(j, 1)
+	if j.State == StateReady {
+		return s.pushReady(j)
+	}
+	return s.pushDelayed(j)
+}
+
+// store inserts a job in Jobs. The spilled body of a job which couldn't be
+// inserted is deleted.
+func (s *StorageService) store(j *Job) error {
+	if err := s.Jobs.Insert(j); err != nil {
+		if j.BodyRef != nil {
+			s.Bodies.Delete(*j.BodyRef)
+			j.BodyRef = nil
+		}
+		return err
+	}
+	s.Memory.Add(int64(len(j.Body)))
+	return nil
+}
+
+// Spill moves the body of a job of at least SpillSize bytes to Bodies and
+// sets its BodyRef. j.Body is kept until the job is stored, so that it still
+// can be logged. Spill only uses Bodies, so it may be called without holding
+// a lock. The body is deleted along with the job, or by Add or Restore if the
+// job can't be stored.
+func (s *StorageService) Spill(j *Job) error {
+	if s.Bodies == nil || j.BodyRef != nil || len(j.Body) < s.SpillSize {
+		return nil
 	}
+	ref, err := s.Bodies.Put(j.Body)
+	if err != nil {
+		return err
+	}
+	j.BodyRef = &ref
 	return nil
 }
 
+// OpenBody returns a reader of the body of a job, whether it's in memory or
+// spilled to Bodies. Returns ErrJobMissing if the job has been deleted, since
+// its spilled body may be gone. The reader must be closed.
+func (s *StorageService) OpenBody(j *Job) (io.ReadCloser, error) {
+	if j.BodyRef == nil {
+		return io.NopCloser(bytes.NewReader(j.Body)), nil
+	}
+	if _, err := s.Jobs.GetByID(j.ID); err != nil {
+		return nil, err
+	}
+	return s.Bodies.Open(*j.BodyRef)
+}
+
+// Restore adds a job which was stored before the server was restarted. Buried
+// jobs stay buried and are kicked in the order they are restored. Reserved
+// jobs are made ready, since the clients that reserved them are gone. Other
+// jobs are added like Add does, but aren't counted as new jobs. Returns
+// ErrJobAlreadyExist if a job with the given ID already exists.
+func (s *StorageService) Restore(j *Job) error {
+	switch j.State {
+	case StateBuried:
+		if err := s.store(j); err != nil {
+			return err
+		}
+		q := s.queues(j.Tube)
+		q.count(j, 1)
+		return q.buried.Push(j)
+	case StateReserved:
+		j.RunnableAt = nil
+	}
+	return s.insert(j)
+}
+
 // Update updates a preexisting job's metadata. Returns ErrJobMissing if the
-// job could not be found.
+// job could not be found. Its Tube and State must not be changed, and neither
+// may the Priority of a ready job, since the tube's counters would be wrong.
 func (s *StorageService) Update(j *Job) error {
 	if err := s.Jobs.Update(j); err != nil {
 		return err
 	}
-	s.ReadyQueue.Update(j)
-	s.DelayQueue.Update(j)
+	q := s.queues(j.Tube)
+	switch j.State {
+	case StateReady:
+		q.ready.Update(j)
+		s.fixReady(j.Tube)
+	case StateDelayed:
+		q.delay.Update(j)
+		s.DelayTubes.FixByTube(j.Tube)
+	}
 	return nil
 }
 
-// DeleteByID deletes a job with the given ID. Returns ErrJobMissing if the job
-// could not be found.
-func (s *StorageService) DeleteByID(id JobID) error {
+// DeleteByID deletes a job with the given ID on behalf of client. Returns
+// ErrJobMissing if the job could not be found and ErrReservedByOtherClient if
+// the job is reserved by another client.
+func (s *StorageService) DeleteByID(client ClientID, id JobID) error {
+	j, err := s.Jobs.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if j.State == StateReserved && j.ReservedBy != client {
+		return ErrReservedByOtherClient
+	}
+
 	if err := s.Jobs.DeleteByID(id); err != nil {
 		return err
 	}
-	s.ReadyQueue.RemoveByID(id)
-	s.DelayQueue.RemoveByID(id)
+	s.Memory.Add(-int64(len(j.Body)))
+	if err := s.removeFromQueue(j); err != nil {
+		return err
+	}
+
+	q := s.queues(j.Tube)
+	q.count(j, -1)
+	q.deletes++
+	s.removeIfUnused(j.Tube)
+
+	if j.BodyRef != nil {
+		return s.Bodies.Delete(*j.BodyRef)
+	}
+	return nil
+}
+
+// removeFromQueue removes a job from the queue that its state says it is in.
+// Reserved jobs are in no queue.
+func (s *StorageService) removeFromQueue(j *Job) error {
+	q := s.queues(j.Tube)
+	switch j.State {
+	case StateReady:
+		if err := q.ready.RemoveByID(j.ID); err != nil {
+			return err
+		}
+		s.fixReady(j.Tube)
+	case StateDelayed:
+		if err := q.delay.RemoveByID(j.ID); err != nil {
+			return err
+		}
+		return s.DelayTubes.FixByTube(j.Tube)
+	case StateBuried:
+		return q.buried.RemoveByID(j.ID)
+	}
 	return nil
 }
 
+// pushDelayed adds a job to the delay queue of its tube.
+func (s *StorageService) pushDelayed(j *Job) error {
+	if err := s.queues(j.Tube).delay.Push(j); err != nil {
+		return err
+	}
+	return s.DelayTubes.FixByTube(j.Tube)
+}
+
 // Read queries a preexisting job by ID. Returns ErrJobMissing if the job could
 // not be found.
 func (s *StorageService) Read(id JobID) (*Job, error) {
 	return s.Jobs.GetByID(id)
 }
 
-// PeekNextDelayed return the next ready job. Returns `ErrNoJobReady` if there
-// are no jobs ready.
+// checkTransition returns a *TransitionError if j isn't in state from or if
+// the transition to state to is illegal.
+func checkTransition(j *Job, from, to JobState) error {
+	if j.State != from || !from.CanTransitionTo(to) {
+		return &TransitionError{j.ID, j.State, to}
+	}
+	return nil
+}
+
+// Requeue puts a job reserved by client back in the ready queue after the
+// time-to-run of the reservation has elapsed. reserves is the job's
+// Stats.Reserves when it was reserved, which tells its reservations apart.
+// Nothing is done if the job has been released or reserved again since.
+// Returns ErrJobMissing if the job could not be found.
+func (s *StorageService) Requeue(client ClientID, id JobID, reserves uint64) error {
+	j, err := s.Jobs.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if j.State != StateReserved || j.ReservedBy != client || j.Stats.Reserves != reserves {
+		return nil
+	}
+	if err := s.makeReady(j, StateReserved, func(j *Job) { j.Stats.Timeouts++ }); err != nil {
+		return err
+	}
+	s.report(CounterJobTimeouts, 1)
+	return nil
+}
+
+// Unreserve puts a job reserved by client back in the ready queue with its
+// current priority, without counting a release. It is used for the jobs of a
+// client which disconnects. Nothing is done if the job isn't reserved by
+// client. Returns ErrJobMissing if the job could not be found.
+func (s *StorageService) Unreserve(client ClientID, id JobID) error {
+	j, err := s.Jobs.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if j.State != StateReserved || j.ReservedBy != client {
+		return nil
+	}
+	return s.makeReady(j, StateReserved, func(*Job) {})
+}
+
+// Release puts a job reserved by client back in the ready queue with a new
+// priority. If delay is positive the job is put in the delay queue instead.
+// Returns ErrJobMissing if the job could not be found,
+// ErrReservedByOtherClient if it is reserved by another client and a
+// *TransitionError if it isn't reserved.
+func (s *StorageService) Release(client ClientID, id JobID, pri Priority, delay time.Duration) error {
+	j, err := s.Jobs.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if j.State == StateReserved && j.ReservedBy != client {
+		return ErrReservedByOtherClient
+	}
+
+	to := StateReady
+	var runnableAt *time.Time
+	if delay > 0 {
+		to = StateDelayed
+		at := time.Now().Add(delay)
+		runnableAt = &at
+	}
+	if err := checkTransition(j, StateReserved, to); err != nil {
+		return err
+	}
+
+	err = s.transition(j, func(j *Job) {
+		j.State = to
+		j.Priority = pri
+		j.RunnableAt = runnableAt
+		j.Delay = delay
+		j.Stats.Releases++
+	})
+	if err != nil {
+		return err
+	}
+
+	if to == StateReady {
+		return s.pushReady(j)
+	}
+	return s.pushDelayed(j)
+}
+
+// Bury buries a job reserved by client with a new priority. Returns
+// ErrJobMissing if the job could not be found, ErrReservedByOtherClient if it
+// is reserved by another client and a *TransitionError if it isn't reserved.
+func (s *StorageService) Bury(client ClientID, id JobID, pri Priority) error {
+	j, err := s.Jobs.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if j.State == StateReserved && j.ReservedBy != client {
+		return ErrReservedByOtherClient
+	}
+	if err := checkTransition(j, StateReserved, StateBuried); err != nil {
+		return err
+	}
+
+	err = s.transition(j, func(j *Job) {
+		j.State = StateBuried
+		j.Priority = pri
+		j.Stats.Buries++
+	})
+	if err != nil {
+		return err
+	}
+	return s.queues(j.Tube).buried.Push(j)
+}
+
+// Kick moves at most bound jobs in a tube to its ready queue. If there are
+// buried jobs, only buried jobs are kicked, in the order they were buried.
+// Otherwise delayed jobs are kicked in the order they would have become
+// ready. Returns the number of jobs kicked.
+func (s *StorageService) Kick(tube Tube, bound int) (int, error) {
+	q, ok := s.tubes[tube]
+	if !ok {
+		return 0, nil
+	}
+	if _, err := q.buried.Peek(); err == nil {
+		return s.kickFrom(q.buried, StateBuried, bound)
+	} else if err != ErrEmptyQueue {
+		return 0, err
+	}
+
+	kicked, err := s.kickFrom(q.delay, StateDelayed, bound)
+	if kicked > 0 {
+		s.DelayTubes.FixByTube(tube)
+	}
+	return kicked, err
+}
+
+func (s *StorageService) kickFrom(q peekableQueue, from JobState, bound int) (int, error) {
+	kicked := 0
+	for kicked < bound {
+		j, err := q.Peek()
+		if err == ErrEmptyQueue {
+			break
+		} else if err != nil {
+			return kicked, err
+		}
+		if err := s.makeReady(j, from, countKick); err != nil {
+			return kicked, err
+		}
+		kicked++
+	}
+	return kicked, nil
+}
+
+func countKick(j *Job) {
+	j.Stats.Kicks++
+}
+
+// KickJob moves a single buried or delayed job to the ready queue. Returns
+// ErrJobMissing if the job could not be found and a *TransitionError if it
+// is neither buried nor delayed.
+func (s *StorageService) KickJob(id JobID) error {
+	j, err := s.Jobs.GetByID(id)
+	if err != nil {
+		return err
+	}
+
+	if j.State != StateBuried && j.State != StateDelayed {
+		return &TransitionError{j.ID, j.State, StateReady}
+	}
+	return s.makeReady(j, j.State, countKick)
+}
+
+// transition changes a job using change, stores it and updates the counters
+// of its tube. If the job can't be stored, it's left unchanged. Moving the
+// job between queues is up to the caller.
+func (s *StorageService) transition(j *Job, change func(*Job)) error {
+	old := *j
+	change(j)
+	if err := s.Jobs.Update(j); err != nil {
+		*j = old
+		return err
+	}
+	q := s.queues(j.Tube)
+	q.count(&old, -1)
+	q.count(j, 1)
+	return nil
+}
+
+// makeReady moves a job in state from to the ready queue of its tube, after
+// changing it using change. The job is removed from its previous queue only
+// once it has been stored.
+func (s *StorageService) makeReady(j *Job, from JobState, change func(*Job)) error {
+	if err := checkTransition(j, from, StateReady); err != nil {
+		return err
+	}
+	queued := *j
+	err := s.transition(j, func(j *Job) {
+		change(j)
+		j.State = StateReady
+		j.RunnableAt = nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.removeFromQueue(&queued); err != nil {
+		return err
+	}
+	return s.pushReady(j)
+}
+
+// PromoteDelayed moves all delayed jobs that are runnable at now to the ready
+// queues of their tubes. Returns the number of jobs moved.
+func (s *StorageService) PromoteDelayed(now time.Time) (int, error) {
+	moved := 0
+	for {
+		j, err := s.PeekNextDelayed()
+		if err == ErrNoJobDelayed {
+			return moved, nil
+		} else if err != nil {
+			return moved, err
+		}
+		if j.RunnableAt != nil && j.RunnableAt.After(now) {
+			return moved, nil
+		}
+
+		if err := s.makeReady(j, StateDelayed, func(*Job) {}); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+}
+
+// PeekNextDelayed return the next delayed job across all tubes. Returns
+// `ErrNoJobDelayed` if there are no delayed jobs.
 func (s *StorageService) PeekNextDelayed() (*Job, error) {
-	item, err := s.DelayQueue.Peek()
+	queue, err := s.DelayTubes.Peek()
+	if err == ErrEmptyQueue {
+		return nil, ErrNoJobDelayed
+	} else if err != nil {
+		return nil, err
+	}
+
+	item, err := queue.Peek()
 	if err == ErrEmptyQueue {
 		return nil, ErrNoJobDelayed
 	}
 	return item, err
 }
 
-// PopNextReady returns the next ready job. Returns ErrNoJobReady if no job is
-// ready.
-func (s *StorageService) PopNextReady() (*Job, error) {
-	item, err := s.ReadyQueue.Pop()
+type peekableQueue interface {
+	Peek() (*Job, error)
+}
+
+// peek returns the job at the front of one of a tube's queues, or errEmpty if
+// there is none. Tubes are not created, since peeking only holds a read lock.
+func (s *StorageService) peek(tube Tube, queue func(*tubeQueues) peekableQueue, errEmpty error) (*Job, error) {
+	q, ok := s.tubes[tube]
+	if !ok {
+		return nil, errEmpty
+	}
+
+	j, err := queue(q).Peek()
 	if err == ErrEmptyQueue {
-		return item, ErrNoJobReady
+		return nil, errEmpty
 	}
-	return item, err
+	return j, err
 }
 
-// TODO: Implement when adding tube support.
-//func  (s *StorageService) Tubes() []Tube {
-//}
+// PeekReady returns the next ready job in a tube without reserving it.
+// Returns ErrNoJobReady if the tube has no ready jobs.
+func (s *StorageService) PeekReady(tube Tube) (*Job, error) {
+	return s.peek(tube, func(q *tubeQueues) peekableQueue { return q.ready }, ErrNoJobReady)
+}
+
+// PeekDelayed returns the delayed job in a tube which becomes ready first.
+// Returns ErrNoJobDelayed if the tube has no delayed jobs.
+func (s *StorageService) PeekDelayed(tube Tube) (*Job, error) {
+	return s.peek(tube, func(q *tubeQueues) peekableQueue { return q.delay }, ErrNoJobDelayed)
+}
+
+// PeekBuried returns the buried job in a tube which is kicked first. Returns
+// ErrNoJobBuried if the tube has no buried jobs.
+func (s *StorageService) PeekBuried(tube Tube) (*Job, error) {
+	return s.peek(tube, func(q *tubeQueues) peekableQueue { return q.buried }, ErrNoJobBuried)
+}
+
+// PopNextReady returns the next ready job among the tubes in a watch set and
+// moves it to StateReserved on behalf of client. Returns ErrNoJobReady if no
+// job is ready.
+func (s *StorageService) PopNextReady(client ClientID, ws *WatchSet) (*Job, error) {
+	queue, err := ws.ready.Peek()
+	if err == ErrEmptyQueue {
+		return nil, ErrNoJobReady
+	} else if err != nil {
+		return nil, err
+	}
+
+	item, err := queue.Peek()
+	if err == ErrEmptyQueue {
+		return nil, ErrNoJobReady
+	} else if err != nil {
+		return nil, err
+	}
+	if err := s.reserve(client, item, StateReady); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// ReserveByID reserves a ready, delayed or buried job on behalf of client.
+// Returns ErrJobMissing if the job could not be found and a *TransitionError
+// if it is already reserved.
+func (s *StorageService) ReserveByID(client ClientID, id JobID) (*Job, error) {
+	j, err := s.Jobs.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.reserve(client, j, j.State); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// reserve moves a job in state from to StateReserved on behalf of client. The
+// job is removed from its previous queue only once it has been stored.
+func (s *StorageService) reserve(client ClientID, j *Job, from JobState) error {
+	if err := checkTransition(j, from, StateReserved); err != nil {
+		return err
+	}
+	queued := *j
+	err := s.transition(j, func(j *Job) {
+		j.State = StateReserved
+		j.ReservedBy = client
+		j.RunnableAt = nil
+		j.Stats.Reserves++
+	})
+	if err != nil {
+		return err
+	}
+	return s.removeFromQueue(&queued)
+}
@@ -0,0 +1,99 @@
+package geanstalkd_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/btree"
+
+	"github.com/JensRantil/geanstalkd"
+	"github.com/JensRantil/geanstalkd/inmemory"
+
+	. "testing"
+)
+
+var errUpdateFailed = errors.New("update failed")
+
+// failingUpdateRegistry fails every update while failing is set.
+type failingUpdateRegistry struct {
+	geanstalkd.JobRegistry
+
+	failing bool
+}
+
+func (r *failingUpdateRegistry) Update(j *geanstalkd.Job) error {
+	if r.failing {
+		return errUpdateFailed
+	}
+	return r.JobRegistry.Update(j)
+}
+
+func TestFailedUpdateLeavesJobUnchanged(t *T) {
+	t.Parallel()
+
+	jobs := &failingUpdateRegistry{JobRegistry: inmemory.NewBTreeJobRegistry(btree.New(btree.DefaultFreeListSize))}
+	s := &geanstalkd.StorageService{
+		Jobs:                 jobs,
+		DelayTubes:           inmemory.NewTubeHeapPriorityQueue(),
+		NewJobPriorityQueue:  func() geanstalkd.JobPriorityQueue { return inmemory.NewJobHeapPriorityQueue() },
+		NewJobQueue:          func() geanstalkd.JobQueue { return inmemory.NewJobListQueue() },
+		NewTubePriorityQueue: func() geanstalkd.TubePriorityQueue { return inmemory.NewTubeHeapPriorityQueue() },
+	}
+	ws := s.Watch([]geanstalkd.Tube{"a"})
+	later := time.Now().Add(time.Hour)
+	if err := s.Add(&geanstalkd.Job{ID: 1, Tube: "a", RunnableAt: &later}); err != nil {
+		t.Fatal("Could not add job:", err)
+	}
+
+	// fail checks that a change fails and leaves the job, its queue and the
+	// counters of its tube as they were.
+	fail := func(name string, state geanstalkd.JobState, change func() error) {
+		t.Helper()
+		j, err := s.Read(1)
+		if err != nil {
+			t.Fatal("Could not read job:", err)
+		}
+		before := j.Copy()
+		statsBefore, err := s.TubeStats("a")
+		if err != nil {
+			t.Fatal("Could not read tube stats:", err)
+		}
+
+		jobs.failing = true
+		err = change()
+		jobs.failing = false
+		if err != errUpdateFailed {
+			t.Fatalf("Expected %s to fail. Got: %v", name, err)
+		}
+		if j.State != state || j.Stats != before.Stats || j.ReservedBy != before.ReservedBy || j.RunnableAt != before.RunnableAt {
+			t.Fatalf("Expected %s to leave the job unchanged. Got: %+v", name, j)
+		}
+		if stats, err := s.TubeStats("a"); err != nil || stats != statsBefore {
+			t.Fatalf("Expected %s to leave the counters unchanged. Got: %+v, %v", name, stats, err)
+		}
+	}
+	succeed := func(name string, change func() error) {
+		t.Helper()
+		if err := change(); err != nil {
+			t.Fatalf("Could not %s: %v", name, err)
+		}
+	}
+
+	fail("kick-job", geanstalkd.StateDelayed, func() error { return s.KickJob(1) })
+	fail("promote", geanstalkd.StateDelayed, func() error { _, err := s.PromoteDelayed(later); return err })
+	fail("reserve-job", geanstalkd.StateDelayed, func() error { _, err := s.ReserveByID(0, 1); return err })
+	if _, err := s.PeekDelayed("a"); err != nil {
+		t.Fatal("Expected the job to still be delayed:", err)
+	}
+
+	succeed("kick", func() error { _, err := s.Kick("a", 1); return err })
+	fail("reserve", geanstalkd.StateReady, func() error { _, err := s.PopNextReady(0, ws); return err })
+	if _, err := s.PeekReady("a"); err != nil {
+		t.Fatal("Expected the job to still be ready:", err)
+	}
+
+	succeed("reserve", func() error { _, err := s.PopNextReady(0, ws); return err })
+	fail("release", geanstalkd.StateReserved, func() error { return s.Release(0, 1, 0, 0) })
+	fail("bury", geanstalkd.StateReserved, func() error { return s.Bury(0, 1, 0) })
+	fail("requeue", geanstalkd.StateReserved, func() error { return s.Requeue(0, 1, 1) })
+}
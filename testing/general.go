@@ -1,3 +1,7 @@
 package testing
 
-const testID = 42
+const (
+	testID     = 42
+	testClient = 7
+	testTube   = "test"
+)
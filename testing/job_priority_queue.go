@@ -136,6 +136,7 @@ func GenericJobPriorityQueueTest(jpq geanstalkd.JobPriorityQueue) {
 			{geanstalkd.Job{ID: testID - 3}, "regular job"},
 			{geanstalkd.Job{ID: testID - 2, Priority: 1}, "job with lower priority"},
 			{geanstalkd.Job{ID: testID, Priority: 1}, "job with higher ID"},
+			{geanstalkd.Job{ID: testID - 4, Priority: 2}, "job with even lower priority but lower ID"},
 		}
 
 		for i, job := range orderedJobs {
@@ -0,0 +1,100 @@
+package testing
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// GenericJobQueueTest tests that a JobQueue behaves as a first-in-first-out
+// JobQueue should.
+func GenericJobQueueTest(jq geanstalkd.JobQueue) {
+	Convey("It should behave like a generic JobQueue", func() {
+		testEmptyJobQueue(jq)
+
+		Convey("When adding a job", func() {
+			job := geanstalkd.Job{ID: testID}
+			err := jq.Push(&job)
+			Convey("Then no error should be returned", func() {
+				So(err, ShouldBeNil)
+			})
+			Convey("When adding the same job again", func() {
+				err := jq.Push(&job)
+				Convey("Then ErrJobAlreadyExist should be returned", func() {
+					So(err, ShouldEqual, geanstalkd.ErrJobAlreadyExist)
+				})
+			})
+			Convey("When popping a job", func() {
+				poppedJob, err := jq.Pop()
+				Convey("Then the job popped should be the added job", func() {
+					So(err, ShouldBeNil)
+					So(*poppedJob, shouldHaveEqualJobFields, job)
+				})
+				testEmptyJobQueue(jq)
+			})
+			Convey("When removing the job", func() {
+				err := jq.RemoveByID(job.ID)
+				Convey("Then no error should be returned", func() {
+					So(err, ShouldBeNil)
+				})
+				testEmptyJobQueue(jq)
+			})
+			Convey("When adding a second job with higher priority and lower ID", func() {
+				secondJob := geanstalkd.Job{ID: job.ID - 1, Priority: job.Priority}
+				err := jq.Push(&secondJob)
+				Convey("Then no error should be returned", func() {
+					So(err, ShouldBeNil)
+				})
+				Convey("When peeking a job", func() {
+					peekedJob, err := jq.Peek()
+					Convey("Then the first added job should be returned", func() {
+						So(err, ShouldBeNil)
+						So(*peekedJob, shouldHaveEqualJobFields, job)
+					})
+				})
+				Convey("When popping two jobs", func() {
+					first, err1 := jq.Pop()
+					second, err2 := jq.Pop()
+					Convey("Then they should be returned in the order they were added", func() {
+						So(err1, ShouldBeNil)
+						So(err2, ShouldBeNil)
+						So(*first, shouldHaveEqualJobFields, job)
+						So(*second, shouldHaveEqualJobFields, secondJob)
+					})
+				})
+				Convey("When removing the first job", func() {
+					err := jq.RemoveByID(job.ID)
+					Convey("Then the second job should be at the front", func() {
+						So(err, ShouldBeNil)
+						peekedJob, err := jq.Peek()
+						So(err, ShouldBeNil)
+						So(*peekedJob, shouldHaveEqualJobFields, secondJob)
+					})
+				})
+			})
+		})
+	})
+}
+
+func testEmptyJobQueue(jq geanstalkd.JobQueue) {
+	Convey("Then it should behave like an empty job queue", func() {
+		Convey("When popping an item", func() {
+			_, err := jq.Pop()
+			Convey("Then ErrEmptyQueue should be returned", func() {
+				So(err, ShouldEqual, geanstalkd.ErrEmptyQueue)
+			})
+		})
+		Convey("When peeking an item", func() {
+			_, err := jq.Peek()
+			Convey("Then ErrEmptyQueue should be returned", func() {
+				So(err, ShouldEqual, geanstalkd.ErrEmptyQueue)
+			})
+		})
+		Convey("When removing a job", func() {
+			err := jq.RemoveByID(testID)
+			Convey("Then ErrJobMissing should be returned", func() {
+				So(err, ShouldEqual, geanstalkd.ErrJobMissing)
+			})
+		})
+	})
+}
@@ -0,0 +1,630 @@
+package testing
+
+import (
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/JensRantil/geanstalkd"
+)
+
+// GenericStorageServiceTest tests that a StorageService keeps track of job
+// states and only allows legal state transitions.
+func GenericStorageServiceTest(s *geanstalkd.StorageService) {
+	Convey("It should behave like a generic StorageService", func() {
+		Convey("When adding a ready job", func() {
+			job := geanstalkd.Job{ID: testID, Tube: testTube}
+			err := s.Add(&job)
+			Convey("Then no error should be returned", func() {
+				So(err, ShouldBeNil)
+			})
+			Convey("Then the job should be ready", func() {
+				So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReady)
+			})
+			Convey("When requeueing the job", func() {
+				err := s.Requeue(testClient, job.ID, 0)
+				Convey("Then nothing should happen", func() {
+					So(err, ShouldBeNil)
+					So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReady)
+					So(jobStats(s, job.ID), ShouldResemble, geanstalkd.JobStats{})
+				})
+			})
+			Convey("When peeking the tube's queues", func() {
+				ready, readyErr := s.PeekReady(testTube)
+				_, delayedErr := s.PeekDelayed(testTube)
+				_, buriedErr := s.PeekBuried(testTube)
+				Convey("Then the job should be found only in the ready queue", func() {
+					So(readyErr, ShouldBeNil)
+					So(ready.ID, ShouldEqual, job.ID)
+					So(delayedErr, ShouldEqual, geanstalkd.ErrNoJobDelayed)
+					So(buriedErr, ShouldEqual, geanstalkd.ErrNoJobBuried)
+				})
+				Convey("Then the job should still be ready", func() {
+					So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReady)
+				})
+			})
+			Convey("When peeking the ready queue of another tube", func() {
+				_, err := s.PeekReady(testTube + "_other")
+				Convey("Then ErrNoJobReady should be returned", func() {
+					So(err, ShouldEqual, geanstalkd.ErrNoJobReady)
+				})
+			})
+			Convey("When popping the next ready job", func() {
+				popped, err := s.PopNextReady(testClient, s.Watch([]geanstalkd.Tube{testTube}))
+				Convey("Then no error should be returned", func() {
+					So(err, ShouldBeNil)
+				})
+				Convey("Then the job should no longer be peeked as ready", func() {
+					_, err := s.PeekReady(testTube)
+					So(err, ShouldEqual, geanstalkd.ErrNoJobReady)
+				})
+				Convey("Then the job should be reserved", func() {
+					So(popped.ID, ShouldEqual, job.ID)
+					So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReserved)
+					So(jobStats(s, job.ID), ShouldResemble, geanstalkd.JobStats{Reserves: 1})
+				})
+				Convey("When requeueing the job", func() {
+					err := s.Requeue(testClient, job.ID, 1)
+					Convey("Then no error should be returned", func() {
+						So(err, ShouldBeNil)
+					})
+					Convey("Then the job should be ready", func() {
+						So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReady)
+					})
+					Convey("Then the timeout should be counted", func() {
+						So(jobStats(s, job.ID), ShouldResemble, geanstalkd.JobStats{Reserves: 1, Timeouts: 1})
+					})
+				})
+				Convey("When requeueing an earlier reservation of the job", func() {
+					err := s.Requeue(testClient, job.ID, 0)
+					Convey("Then the job should still be reserved", func() {
+						So(err, ShouldBeNil)
+						So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReserved)
+					})
+				})
+				Convey("When requeueing a reservation by another client", func() {
+					err := s.Requeue(testClient+1, job.ID, 1)
+					Convey("Then the job should still be reserved", func() {
+						So(err, ShouldBeNil)
+						So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReserved)
+					})
+				})
+				Convey("When unreserving the job", func() {
+					err := s.Unreserve(testClient, job.ID)
+					Convey("Then no error should be returned", func() {
+						So(err, ShouldBeNil)
+					})
+					Convey("Then the job should be ready without counting a release", func() {
+						So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReady)
+						So(jobStats(s, job.ID), ShouldResemble, geanstalkd.JobStats{Reserves: 1})
+					})
+				})
+				Convey("When unreserving a job reserved by another client", func() {
+					err := s.Unreserve(testClient+1, job.ID)
+					Convey("Then the job should still be reserved", func() {
+						So(err, ShouldBeNil)
+						So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReserved)
+					})
+				})
+				Convey("When popping the next ready job again", func() {
+					_, err := s.PopNextReady(testClient, s.Watch([]geanstalkd.Tube{testTube}))
+					Convey("Then ErrNoJobReady should be returned", func() {
+						So(err, ShouldEqual, geanstalkd.ErrNoJobReady)
+					})
+				})
+				Convey("When releasing the job with a new priority", func() {
+					err := s.Release(testClient, job.ID, 10, 0)
+					Convey("Then no error should be returned", func() {
+						So(err, ShouldBeNil)
+					})
+					Convey("Then the job should be ready with the new priority", func() {
+						released, err := s.Read(job.ID)
+						So(err, ShouldBeNil)
+						So(released.State, ShouldEqual, geanstalkd.StateReady)
+						So(released.Priority, ShouldEqual, 10)
+						So(released.Stats, ShouldResemble, geanstalkd.JobStats{Reserves: 1, Releases: 1})
+					})
+					Convey("When releasing the job again", func() {
+						err := s.Release(testClient, job.ID, 10, 0)
+						Convey("Then a TransitionError should be returned", func() {
+							So(err, ShouldResemble, &geanstalkd.TransitionError{
+								ID:   job.ID,
+								From: geanstalkd.StateReady,
+								To:   geanstalkd.StateReady,
+							})
+						})
+					})
+				})
+				Convey("When releasing the job with a delay", func() {
+					err := s.Release(testClient, job.ID, 0, time.Hour)
+					Convey("Then the job should be delayed", func() {
+						So(err, ShouldBeNil)
+						So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateDelayed)
+						released, err := s.Read(job.ID)
+						So(err, ShouldBeNil)
+						So(released.Delay, ShouldEqual, time.Hour)
+						_, err = s.PopNextReady(testClient, s.Watch([]geanstalkd.Tube{testTube}))
+						So(err, ShouldEqual, geanstalkd.ErrNoJobReady)
+					})
+				})
+				Convey("When releasing the job as another client", func() {
+					err := s.Release(testClient+1, job.ID, 0, 0)
+					Convey("Then ErrReservedByOtherClient should be returned", func() {
+						So(err, ShouldEqual, geanstalkd.ErrReservedByOtherClient)
+						So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReserved)
+					})
+				})
+				Convey("When burying the job", func() {
+					err := s.Bury(testClient, job.ID, 10)
+					Convey("Then the job should be buried", func() {
+						So(err, ShouldBeNil)
+						So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateBuried)
+						So(jobStats(s, job.ID), ShouldResemble, geanstalkd.JobStats{Reserves: 1, Buries: 1})
+						_, err := s.PopNextReady(testClient, s.Watch([]geanstalkd.Tube{testTube}))
+						So(err, ShouldEqual, geanstalkd.ErrNoJobReady)
+					})
+					Convey("Then the job should be peeked as buried", func() {
+						buried, err := s.PeekBuried(testTube)
+						So(err, ShouldBeNil)
+						So(buried.ID, ShouldEqual, job.ID)
+					})
+					Convey("When releasing the buried job", func() {
+						err := s.Release(testClient, job.ID, 0, 0)
+						Convey("Then a TransitionError should be returned", func() {
+							So(err, ShouldResemble, &geanstalkd.TransitionError{
+								ID:   job.ID,
+								From: geanstalkd.StateBuried,
+								To:   geanstalkd.StateReady,
+							})
+						})
+					})
+					Convey("When kicking jobs", func() {
+						kicked, err := s.Kick(testTube, 10)
+						Convey("Then the job should be ready", func() {
+							So(err, ShouldBeNil)
+							So(kicked, ShouldEqual, 1)
+							So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReady)
+							So(jobStats(s, job.ID), ShouldResemble, geanstalkd.JobStats{Reserves: 1, Buries: 1, Kicks: 1})
+						})
+					})
+					Convey("When kicking the job", func() {
+						err := s.KickJob(job.ID)
+						Convey("Then the job should be ready", func() {
+							So(err, ShouldBeNil)
+							So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReady)
+							So(jobStats(s, job.ID), ShouldResemble, geanstalkd.JobStats{Reserves: 1, Buries: 1, Kicks: 1})
+						})
+					})
+					Convey("When deleting the job", func() {
+						err := s.DeleteByID(testClient, job.ID)
+						Convey("Then no job should be kicked", func() {
+							So(err, ShouldBeNil)
+							kicked, err := s.Kick(testTube, 10)
+							So(err, ShouldBeNil)
+							So(kicked, ShouldEqual, 0)
+						})
+					})
+				})
+				Convey("When kicking the reserved job", func() {
+					err := s.KickJob(job.ID)
+					Convey("Then a TransitionError should be returned", func() {
+						So(err, ShouldResemble, &geanstalkd.TransitionError{
+							ID:   job.ID,
+							From: geanstalkd.StateReserved,
+							To:   geanstalkd.StateReady,
+						})
+					})
+				})
+				Convey("When deleting the job as another client", func() {
+					err := s.DeleteByID(testClient+1, job.ID)
+					Convey("Then ErrReservedByOtherClient should be returned", func() {
+						So(err, ShouldEqual, geanstalkd.ErrReservedByOtherClient)
+					})
+				})
+			})
+		})
+
+		Convey("When adding a delayed job", func() {
+			runnableAt := time.Now().Add(time.Hour)
+			job := geanstalkd.Job{ID: testID, Tube: testTube, RunnableAt: &runnableAt}
+			err := s.Add(&job)
+			Convey("Then no error should be returned", func() {
+				So(err, ShouldBeNil)
+			})
+			Convey("Then the job should be delayed", func() {
+				So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateDelayed)
+			})
+			Convey("Then the job should be peeked as delayed", func() {
+				delayed, err := s.PeekDelayed(testTube)
+				So(err, ShouldBeNil)
+				So(delayed.ID, ShouldEqual, job.ID)
+				_, err = s.PeekReady(testTube)
+				So(err, ShouldEqual, geanstalkd.ErrNoJobReady)
+			})
+			Convey("When requeueing the job", func() {
+				err := s.Requeue(testClient, job.ID, 0)
+				Convey("Then nothing should happen", func() {
+					So(err, ShouldBeNil)
+					So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateDelayed)
+				})
+			})
+			Convey("When reserving the job by ID", func() {
+				reserved, err := s.ReserveByID(testClient, job.ID)
+				Convey("Then the job should be reserved by the client", func() {
+					So(err, ShouldBeNil)
+					So(reserved.ID, ShouldEqual, job.ID)
+					So(reserved.ReservedBy, ShouldEqual, testClient)
+					So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReserved)
+				})
+				Convey("Then the job should no longer be delayed", func() {
+					_, err := s.PeekDelayed(testTube)
+					So(err, ShouldEqual, geanstalkd.ErrNoJobDelayed)
+					moved, err := s.PromoteDelayed(runnableAt)
+					So(err, ShouldBeNil)
+					So(moved, ShouldEqual, 0)
+				})
+				Convey("When reserving the job by ID again", func() {
+					_, err := s.ReserveByID(testClient, job.ID)
+					Convey("Then a TransitionError should be returned", func() {
+						So(err, ShouldResemble, &geanstalkd.TransitionError{
+							ID:   job.ID,
+							From: geanstalkd.StateReserved,
+							To:   geanstalkd.StateReserved,
+						})
+					})
+				})
+			})
+			Convey("When promoting delayed jobs before the job is runnable", func() {
+				moved, err := s.PromoteDelayed(time.Now())
+				Convey("Then no job should be moved", func() {
+					So(err, ShouldBeNil)
+					So(moved, ShouldEqual, 0)
+					So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateDelayed)
+				})
+			})
+			Convey("When kicking jobs", func() {
+				kicked, err := s.Kick(testTube, 10)
+				Convey("Then the job should be ready", func() {
+					So(err, ShouldBeNil)
+					So(kicked, ShouldEqual, 1)
+					So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReady)
+				})
+			})
+			Convey("When promoting delayed jobs after the job is runnable", func() {
+				moved, err := s.PromoteDelayed(runnableAt)
+				Convey("Then the job should be ready", func() {
+					So(err, ShouldBeNil)
+					So(moved, ShouldEqual, 1)
+					So(jobState(s, job.ID), ShouldEqual, geanstalkd.StateReady)
+				})
+			})
+		})
+
+		Convey("When adding jobs to two different tubes", func() {
+			otherTube := geanstalkd.Tube(testTube + "_other")
+			job := geanstalkd.Job{ID: testID, Tube: testTube, Priority: 1}
+			otherJob := geanstalkd.Job{ID: testID + 1, Tube: otherTube}
+			So(s.Add(&job), ShouldBeNil)
+			So(s.Add(&otherJob), ShouldBeNil)
+
+			Convey("When popping from one of the tubes", func() {
+				popped, err := s.PopNextReady(testClient, s.Watch([]geanstalkd.Tube{testTube}))
+				Convey("Then only the job in the watched tube should be returned", func() {
+					So(err, ShouldBeNil)
+					So(popped.ID, ShouldEqual, job.ID)
+				})
+			})
+			Convey("When popping from both tubes", func() {
+				popped, err := s.PopNextReady(testClient, s.Watch([]geanstalkd.Tube{testTube, otherTube}))
+				Convey("Then the job with highest priority should be returned", func() {
+					So(err, ShouldBeNil)
+					So(popped.ID, ShouldEqual, otherJob.ID)
+				})
+			})
+			Convey("When popping from a tube without jobs", func() {
+				_, err := s.PopNextReady(testClient, s.Watch([]geanstalkd.Tube{"missing"}))
+				Convey("Then ErrNoJobReady should be returned", func() {
+					So(err, ShouldEqual, geanstalkd.ErrNoJobReady)
+				})
+			})
+		})
+
+		Convey("When adding jobs to a tube", func() {
+			urgent := geanstalkd.Job{ID: testID, Tube: testTube, Priority: 0}
+			notUrgent := geanstalkd.Job{ID: testID + 1, Tube: testTube, Priority: geanstalkd.UrgentPriority}
+			runnableAt := time.Now().Add(time.Hour)
+			delayed := geanstalkd.Job{ID: testID + 2, Tube: testTube, RunnableAt: &runnableAt}
+			So(s.Add(&urgent), ShouldBeNil)
+			So(s.Add(&notUrgent), ShouldBeNil)
+			So(s.Add(&delayed), ShouldBeNil)
+
+			Convey("Then the tube should exist", func() {
+				So(s.Tubes(), ShouldContain, geanstalkd.Tube(testTube))
+			})
+			Convey("Then the tube's jobs should be counted by state", func() {
+				stats, err := s.TubeStats(testTube)
+				So(err, ShouldBeNil)
+				So(stats, ShouldResemble, geanstalkd.TubeStats{
+					Name:        testTube,
+					UrgentJobs:  1,
+					ReadyJobs:   2,
+					DelayedJobs: 1,
+					TotalJobs:   3,
+				})
+			})
+			Convey("Then the jobs should be counted server-wide", func() {
+				So(s.Stats(), ShouldResemble, geanstalkd.StorageStats{
+					UrgentJobs:  1,
+					ReadyJobs:   2,
+					DelayedJobs: 1,
+					Tubes:       2,
+				})
+			})
+			Convey("When reserving, burying and deleting jobs", func() {
+				ws := s.Watch([]geanstalkd.Tube{testTube})
+				popped, err := s.PopNextReady(testClient, ws)
+				So(err, ShouldBeNil)
+				So(s.Bury(testClient, popped.ID, 0), ShouldBeNil)
+				popped, err = s.PopNextReady(testClient, ws)
+				So(err, ShouldBeNil)
+				So(s.DeleteByID(testClient, delayed.ID), ShouldBeNil)
+
+				Convey("Then the tube's counters should be updated", func() {
+					stats, err := s.TubeStats(testTube)
+					So(err, ShouldBeNil)
+					So(stats, ShouldResemble, geanstalkd.TubeStats{
+						Name:         testTube,
+						ReservedJobs: 1,
+						BuriedJobs:   1,
+						TotalJobs:    3,
+						Watching:     1,
+						Deletes:      1,
+					})
+				})
+			})
+			Convey("When deleting all jobs", func() {
+				So(s.DeleteByID(testClient, urgent.ID), ShouldBeNil)
+				So(s.DeleteByID(testClient, notUrgent.ID), ShouldBeNil)
+				So(s.DeleteByID(testClient, delayed.ID), ShouldBeNil)
+				Convey("Then the tube should be removed", func() {
+					So(s.Tubes(), ShouldNotContain, geanstalkd.Tube(testTube))
+					_, err := s.TubeStats(testTube)
+					So(err, ShouldEqual, geanstalkd.ErrTubeMissing)
+				})
+			})
+		})
+
+		Convey("When using a tube", func() {
+			s.Use(testTube)
+			Convey("Then the tube should exist", func() {
+				stats, err := s.TubeStats(testTube)
+				So(err, ShouldBeNil)
+				So(stats.Using, ShouldEqual, 1)
+			})
+			Convey("When no longer using the tube", func() {
+				s.Unuse(testTube)
+				Convey("Then the tube should be removed", func() {
+					_, err := s.TubeStats(testTube)
+					So(err, ShouldEqual, geanstalkd.ErrTubeMissing)
+				})
+			})
+		})
+
+		Convey("When no tubes have been used", func() {
+			Convey("Then the default tube should exist", func() {
+				So(s.Tubes(), ShouldResemble, []geanstalkd.Tube{geanstalkd.DefaultTube})
+				_, err := s.TubeStats(geanstalkd.DefaultTube)
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When pausing a tube with a ready job", func() {
+			job := geanstalkd.Job{ID: testID, Tube: testTube}
+			So(s.Add(&job), ShouldBeNil)
+			ws := s.Watch([]geanstalkd.Tube{testTube})
+			So(s.PauseTube(testTube, time.Hour), ShouldBeNil)
+
+			Convey("Then no job should be ready", func() {
+				_, err := s.PopNextReady(testClient, ws)
+				So(err, ShouldEqual, geanstalkd.ErrNoJobReady)
+			})
+			Convey("Then the pause should be reported", func() {
+				stats, err := s.TubeStats(testTube)
+				So(err, ShouldBeNil)
+				So(stats.Pauses, ShouldEqual, 1)
+				So(stats.Pause, ShouldEqual, time.Hour)
+				So(stats.PauseTimeLeft, ShouldBeGreaterThan, 59*time.Minute)
+				next, ok := s.NextResume()
+				So(ok, ShouldBeTrue)
+				So(next, ShouldHappenAfter, time.Now())
+			})
+			Convey("When adding another job and watching the tube again", func() {
+				other := geanstalkd.Job{ID: testID + 1, Tube: testTube}
+				So(s.Add(&other), ShouldBeNil)
+				ws2 := s.Watch([]geanstalkd.Tube{testTube, testTube + "_other"})
+				Convey("Then no job should be ready", func() {
+					_, err := s.PopNextReady(testClient, ws)
+					So(err, ShouldEqual, geanstalkd.ErrNoJobReady)
+					_, err = s.PopNextReady(testClient, ws2)
+					So(err, ShouldEqual, geanstalkd.ErrNoJobReady)
+				})
+				Convey("When resuming the tube", func() {
+					resumed, err := s.ResumePaused(time.Now().Add(time.Hour))
+					So(err, ShouldBeNil)
+					So(resumed, ShouldEqual, 1)
+					Convey("Then the jobs should be ready in both watch sets", func() {
+						popped, err := s.PopNextReady(testClient, ws)
+						So(err, ShouldBeNil)
+						So(popped.ID, ShouldEqual, job.ID)
+						popped, err = s.PopNextReady(testClient, ws2)
+						So(err, ShouldBeNil)
+						So(popped.ID, ShouldEqual, other.ID)
+					})
+				})
+			})
+			Convey("When resuming paused tubes before the pause has ended", func() {
+				resumed, err := s.ResumePaused(time.Now())
+				Convey("Then the tube should still be paused", func() {
+					So(err, ShouldBeNil)
+					So(resumed, ShouldEqual, 0)
+					_, err := s.PopNextReady(testClient, ws)
+					So(err, ShouldEqual, geanstalkd.ErrNoJobReady)
+				})
+			})
+			Convey("When resuming paused tubes after the pause has ended", func() {
+				resumed, err := s.ResumePaused(time.Now().Add(time.Hour))
+				Convey("Then the job should be ready", func() {
+					So(err, ShouldBeNil)
+					So(resumed, ShouldEqual, 1)
+					popped, err := s.PopNextReady(testClient, ws)
+					So(err, ShouldBeNil)
+					So(popped.ID, ShouldEqual, job.ID)
+					_, ok := s.NextResume()
+					So(ok, ShouldBeFalse)
+				})
+			})
+		})
+
+		Convey("When pausing a tube which doesn't exist", func() {
+			err := s.PauseTube(testTube, time.Hour)
+			Convey("Then ErrTubeMissing should be returned", func() {
+				So(err, ShouldEqual, geanstalkd.ErrTubeMissing)
+			})
+		})
+
+		Convey("When watching two tubes before adding jobs", func() {
+			otherTube := geanstalkd.Tube(testTube + "_other")
+			ws := s.Watch([]geanstalkd.Tube{testTube, otherTube})
+
+			Convey("Then watching the same tubes should share the watch set", func() {
+				So(s.Watch([]geanstalkd.Tube{otherTube, testTube, otherTube}), ShouldEqual, ws)
+			})
+
+			lowPrio := geanstalkd.Job{ID: testID, Tube: testTube, Priority: 10}
+			highPrio := geanstalkd.Job{ID: testID + 1, Tube: otherTube, Priority: 5}
+			So(s.Add(&lowPrio), ShouldBeNil)
+			So(s.Add(&highPrio), ShouldBeNil)
+
+			Convey("When popping jobs", func() {
+				first, err1 := s.PopNextReady(testClient, ws)
+				second, err2 := s.PopNextReady(testClient, ws)
+				_, err3 := s.PopNextReady(testClient, ws)
+				Convey("Then they should be returned in priority order across tubes", func() {
+					So(err1, ShouldBeNil)
+					So(err2, ShouldBeNil)
+					So(first.ID, ShouldEqual, highPrio.ID)
+					So(second.ID, ShouldEqual, lowPrio.ID)
+					So(err3, ShouldEqual, geanstalkd.ErrNoJobReady)
+				})
+				Convey("When releasing the first job with lowest priority", func() {
+					So(s.Release(testClient, first.ID, 20, 0), ShouldBeNil)
+					So(s.Release(testClient, second.ID, 10, 0), ShouldBeNil)
+					popped, err := s.PopNextReady(testClient, ws)
+					Convey("Then the watch set should reflect the new priority", func() {
+						So(err, ShouldBeNil)
+						So(popped.ID, ShouldEqual, lowPrio.ID)
+					})
+				})
+			})
+			Convey("When deleting the high priority job", func() {
+				So(s.DeleteByID(testClient, highPrio.ID), ShouldBeNil)
+				popped, err := s.PopNextReady(testClient, ws)
+				Convey("Then the other job should be returned", func() {
+					So(err, ShouldBeNil)
+					So(popped.ID, ShouldEqual, lowPrio.ID)
+				})
+			})
+			Convey("When unwatching and watching again", func() {
+				s.Unwatch(ws)
+				ws2 := s.Watch([]geanstalkd.Tube{testTube, otherTube})
+				popped, err := s.PopNextReady(testClient, ws2)
+				Convey("Then the jobs should still be reservable", func() {
+					So(err, ShouldBeNil)
+					So(popped.ID, ShouldEqual, highPrio.ID)
+				})
+			})
+		})
+
+		Convey("When adding delayed jobs to two different tubes", func() {
+			otherTube := geanstalkd.Tube(testTube + "_other")
+			early, late := time.Now().Add(time.Hour), time.Now().Add(2*time.Hour)
+			lateJob := geanstalkd.Job{ID: testID, Tube: testTube, RunnableAt: &late}
+			earlyJob := geanstalkd.Job{ID: testID + 1, Tube: otherTube, RunnableAt: &early}
+			So(s.Add(&lateJob), ShouldBeNil)
+			So(s.Add(&earlyJob), ShouldBeNil)
+
+			Convey("Then the next delayed job should be the earliest across tubes", func() {
+				next, err := s.PeekNextDelayed()
+				So(err, ShouldBeNil)
+				So(next.ID, ShouldEqual, earlyJob.ID)
+			})
+			Convey("When promoting the earliest job", func() {
+				moved, err := s.PromoteDelayed(early)
+				Convey("Then only that job should be ready", func() {
+					So(err, ShouldBeNil)
+					So(moved, ShouldEqual, 1)
+					So(jobState(s, earlyJob.ID), ShouldEqual, geanstalkd.StateReady)
+					So(jobState(s, lateJob.ID), ShouldEqual, geanstalkd.StateDelayed)
+				})
+			})
+		})
+
+		Convey("When restoring jobs", func() {
+			first := geanstalkd.Job{ID: testID, Tube: testTube, State: geanstalkd.StateBuried}
+			second := geanstalkd.Job{ID: testID + 1, Tube: testTube, State: geanstalkd.StateBuried}
+			reserved := geanstalkd.Job{
+				ID:    testID + 2,
+				Tube:  testTube,
+				State: geanstalkd.StateReserved,
+				Stats: geanstalkd.JobStats{Reserves: 1},
+			}
+			So(s.Restore(&first), ShouldBeNil)
+			So(s.Restore(&second), ShouldBeNil)
+			So(s.Restore(&reserved), ShouldBeNil)
+
+			Convey("Then buried jobs should be kicked in the order they were restored", func() {
+				kicked, err := s.Kick(testTube, 1)
+				So(err, ShouldBeNil)
+				So(kicked, ShouldEqual, 1)
+				So(jobState(s, first.ID), ShouldEqual, geanstalkd.StateReady)
+				So(jobState(s, second.ID), ShouldEqual, geanstalkd.StateBuried)
+			})
+			Convey("Then the reserved job should be ready with its stats kept", func() {
+				So(jobState(s, reserved.ID), ShouldEqual, geanstalkd.StateReady)
+				So(jobStats(s, reserved.ID).Reserves, ShouldEqual, 1)
+			})
+			Convey("Then the jobs should be counted but not as new jobs", func() {
+				stats, err := s.TubeStats(testTube)
+				So(err, ShouldBeNil)
+				So(stats.BuriedJobs, ShouldEqual, 2)
+				So(stats.ReadyJobs, ShouldEqual, 1)
+				So(stats.TotalJobs, ShouldEqual, 0)
+			})
+			Convey("When restoring a job again", func() {
+				err := s.Restore(&first)
+				Convey("Then ErrJobAlreadyExist should be returned", func() {
+					So(err, ShouldEqual, geanstalkd.ErrJobAlreadyExist)
+				})
+			})
+		})
+
+		Convey("When requeueing a missing job", func() {
+			err := s.Requeue(testClient, testID, 0)
+			Convey("Then ErrJobMissing should be returned", func() {
+				So(err, ShouldEqual, geanstalkd.ErrJobMissing)
+			})
+		})
+	})
+}
+
+func jobState(s *geanstalkd.StorageService, id geanstalkd.JobID) geanstalkd.JobState {
+	j, err := s.Read(id)
+	So(err, ShouldBeNil)
+	return j.State
+}
+
+func jobStats(s *geanstalkd.StorageService, id geanstalkd.JobID) geanstalkd.JobStats {
+	j, err := s.Read(id)
+	So(err, ShouldBeNil)
+	return j.Stats
+}
@@ -0,0 +1,294 @@
+package geanstalkd
+
+import (
+	"container/heap"
+	"log"
+	"sync"
+	"time"
+)
+
+// DeadlineSoonMargin is the duration before a reserved job times out during
+// which its client is told that the deadline is soon.
+const DeadlineSoonMargin = time.Second
+
+// requeueRetryInterval is how long to wait before trying again to requeue a
+// timed out job which couldn't be requeued.
+const requeueRetryInterval = time.Second
+
+type reservation struct {
+	id     JobID
+	client ClientID
+	// reserves is the job's Stats.Reserves when it was reserved, which tells
+	// its reservations apart.
+	reserves uint64
+	ttr      time.Duration
+	deadline time.Time
+	index    int
+}
+
+// Implementation of the container/heap.Interface. Reservations are ordered by
+// deadline.
+type reservationHeap []*reservation
+
+func (h reservationHeap) Len() int { return len(h) }
+
+func (h reservationHeap) Less(i, j int) bool {
+	return h[i].deadline.Before(h[j].deadline)
+}
+
+func (h reservationHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *reservationHeap) Push(x interface{}) {
+	r := x.(*reservation)
+	r.index = len(*h)
+	*h = append(*h, r)
+}
+
+func (h *reservationHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	r := old[n-1]
+	*h = old[0 : n-1]
+	return r
+}
+
+// HeapTTRService is an in-memory TTRService backed by a heap of reservation
+// deadlines. Jobs whose time-to-run has elapsed are put back in the ready
+// queue of the LockService. Use NewHeapTTRService to create one.
+type HeapTTRService struct {
+	storage *LockService
+
+	lock     sync.Mutex
+	heap     reservationHeap
+	byID     map[JobID]*reservation
+	byClient map[ClientID]map[JobID]*reservation
+
+	// wakeup is signalled when the earliest deadline might have changed.
+	wakeup chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewHeapTTRService creates a new HeapTTRService and starts its background
+// goroutine. Call Close to stop it.
+func NewHeapTTRService(storage *LockService) *HeapTTRService {
+	t := &HeapTTRService{
+		storage:  storage,
+		byID:     make(map[JobID]*reservation),
+		byClient: make(map[ClientID]map[JobID]*reservation),
+		wakeup:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	t.wg.Add(1)
+	go t.run()
+
+	return t
+}
+
+// Reserve starts tracking a job reserved by client. The job will be put back
+// in the ready queue when its time-to-run has elapsed.
+func (t *HeapTTRService) Reserve(client ClientID, j Job) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, exists := t.byID[j.ID]; exists {
+		t.remove(j.ID)
+	}
+
+	t.add(&reservation{
+		id:       j.ID,
+		client:   client,
+		reserves: j.Stats.Reserves,
+		ttr:      j.TimeToRun,
+		deadline: time.Now().Add(j.TimeToRun),
+	})
+}
+
+// add must be called while holding t.lock.
+func (t *HeapTTRService) add(r *reservation) {
+	heap.Push(&t.heap, r)
+	t.byID[r.id] = r
+	if _, ok := t.byClient[r.client]; !ok {
+		t.byClient[r.client] = make(map[JobID]*reservation)
+	}
+	t.byClient[r.client][r.id] = r
+
+	t.notify()
+}
+
+// Delete stops tracking a job reserved by client. Deleting a job which isn't
+// tracked, or which is reserved by another client, is a no-op. The latter can
+// happen if the job timed out and was reserved by someone else.
+func (t *HeapTTRService) Delete(client ClientID, id JobID) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if r, exists := t.byID[id]; exists && r.client == client {
+		t.remove(id)
+	}
+}
+
+// Touch gives a job reserved by client its full time-to-run again. Returns
+// ErrJobMissing if the job isn't reserved by client.
+func (t *HeapTTRService) Touch(client ClientID, id JobID) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	r, ok := t.byID[id]
+	if !ok || r.client != client {
+		return ErrJobMissing
+	}
+	r.deadline = time.Now().Add(r.ttr)
+	heap.Fix(&t.heap, r.index)
+
+	return nil
+}
+
+// NextDeadline returns the earliest deadline among the jobs reserved by
+// client. Returns false if the client has no reserved jobs.
+func (t *HeapTTRService) NextDeadline(client ClientID) (time.Time, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var next time.Time
+	found := false
+	for _, r := range t.byClient[client] {
+		if !found || r.deadline.Before(next) {
+			next = r.deadline
+			found = true
+		}
+	}
+	return next, found
+}
+
+// Reserved returns the jobs reserved by client which haven't timed out.
+func (t *HeapTTRService) Reserved(client ClientID) []JobID {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ids := make([]JobID, 0, len(t.byClient[client]))
+	for id := range t.byClient[client] {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Deadline returns when a reserved job times out. Returns false if the job
+// isn't tracked.
+func (t *HeapTTRService) Deadline(id JobID) (time.Time, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	r, ok := t.byID[id]
+	if !ok {
+		return time.Time{}, false
+	}
+	return r.deadline, true
+}
+
+// Close stops the background goroutine. Reservations are no longer timed out
+// after Close has returned.
+func (t *HeapTTRService) Close() error {
+	close(t.done)
+	t.wg.Wait()
+	return nil
+}
+
+// remove must be called while holding t.lock.
+func (t *HeapTTRService) remove(id JobID) {
+	r := t.byID[id]
+	heap.Remove(&t.heap, r.index)
+	delete(t.byID, id)
+
+	clientReservations := t.byClient[r.client]
+	delete(clientReservations, id)
+	if len(clientReservations) == 0 {
+		delete(t.byClient, r.client)
+	}
+}
+
+// notify must be called while holding t.lock.
+func (t *HeapTTRService) notify() {
+	select {
+	case t.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// popExpired removes and returns the reservations whose deadline has passed,
+// as well as the next deadline if there is one. Must be called while holding
+// t.lock.
+func (t *HeapTTRService) popExpired(now time.Time) (expired []*reservation, next *time.Time) {
+	for len(t.heap) > 0 {
+		r := t.heap[0]
+		if r.deadline.After(now) {
+			deadline := r.deadline
+			return expired, &deadline
+		}
+		t.remove(r.id)
+		expired = append(expired, r)
+	}
+	return expired, nil
+}
+
+// requeue puts a timed out job back in the ready queue. If that fails, it's
+// retried later, so that the job isn't left reserved forever.
+func (t *HeapTTRService) requeue(r *reservation) {
+	// The job might have been released or reserved again since it timed out,
+	// in which case this is a no-op. ErrJobMissing means it was deleted.
+	err := t.storage.Requeue(r.client, r.id, r.reserves)
+	if err == nil || err == ErrJobMissing {
+		return
+	}
+	log.Println("Could not requeue timed out job", r.id, ":", err)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, exists := t.byID[r.id]; !exists {
+		r.deadline = time.Now().Add(requeueRetryInterval)
+		t.add(r)
+	}
+}
+
+func (t *HeapTTRService) run() {
+	defer t.wg.Done()
+
+	for {
+		t.lock.Lock()
+		expired, next := t.popExpired(time.Now())
+		t.lock.Unlock()
+
+		// Not holding t.lock here since LockService might be calling us while
+		// holding its own lock.
+		for _, r := range expired {
+			t.requeue(r)
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if next != nil {
+			timer = time.NewTimer(time.Until(*next))
+			timeout = timer.C
+		}
+
+		stopped := false
+		select {
+		case <-timeout:
+		case <-t.wakeup:
+		case <-t.done:
+			stopped = true
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if stopped {
+			return
+		}
+	}
+}
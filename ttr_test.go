@@ -0,0 +1,145 @@
+package geanstalkd_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/JensRantil/geanstalkd"
+
+	. "testing"
+)
+
+func TestTimedOutReservationIsRequeued(t *T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newTestServer(ctx)
+	defer closeTestServer(srv)
+
+	job := addTestJob(t, srv, 0, time.Second)
+
+	if _, err := srv.Reserve(ctx, 1, srv.Watch(defaultTubes)); err != nil {
+		t.Fatal("Could not reserve job:", err)
+	}
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer timeoutCancel()
+	reserved, err := srv.Reserve(timeoutCtx, 2, srv.Watch(defaultTubes))
+	if err != nil {
+		t.Fatal("Expected the job to be requeued. Error:", err)
+	}
+	if reserved.ID != job.ID {
+		t.Errorf("Unexpected job reserved. Reserved: %d Expected: %d", reserved.ID, job.ID)
+	}
+	if timeouts := srv.Statistics.Get(geanstalkd.CounterJobTimeouts); timeouts != 1 {
+		t.Error("Expected the timeout to be counted. Got:", timeouts)
+	}
+}
+
+func TestDeadlineSoon(t *T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newTestServer(ctx)
+	defer closeTestServer(srv)
+
+	addTestJob(t, srv, 0, 2*time.Second)
+
+	if _, err := srv.Reserve(ctx, 1, srv.Watch(defaultTubes)); err != nil {
+		t.Fatal("Could not reserve job:", err)
+	}
+
+	start := time.Now()
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer timeoutCancel()
+	if _, err := srv.Reserve(timeoutCtx, 1, srv.Watch(defaultTubes)); err != geanstalkd.ErrDeadlineSoon {
+		t.Error("Expected ErrDeadlineSoon. Got:", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Error("DEADLINE_SOON returned too early:", elapsed)
+	}
+}
+
+func TestDeletedReservationIsNotRequeued(t *T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newTestServer(ctx)
+	defer closeTestServer(srv)
+
+	job := addTestJob(t, srv, 0, time.Second)
+
+	if _, err := srv.Reserve(ctx, 1, srv.Watch(defaultTubes)); err != nil {
+		t.Fatal("Could not reserve job:", err)
+	}
+	if err := srv.DeleteByID(1, job.ID); err != nil {
+		t.Fatal("Could not delete job:", err)
+	}
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer timeoutCancel()
+	if _, err := srv.Reserve(timeoutCtx, 1, srv.Watch(defaultTubes)); err != context.DeadlineExceeded {
+		t.Error("Expected no job to be reserved. Got:", err)
+	}
+}
+
+func TestTouchedReservationIsExtended(t *T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newTestServer(ctx)
+	defer closeTestServer(srv)
+
+	job := addTestJob(t, srv, 0, 2*time.Second)
+
+	if _, err := srv.Reserve(ctx, 1, srv.Watch(defaultTubes)); err != nil {
+		t.Fatal("Could not reserve job:", err)
+	}
+	time.Sleep(time.Second)
+	if err := srv.Touch(2, job.ID); err != geanstalkd.ErrJobMissing {
+		t.Error("Expected another client not to be able to touch the job. Got:", err)
+	}
+	if err := srv.Touch(1, job.ID); err != nil {
+		t.Fatal("Could not touch job:", err)
+	}
+
+	// Without the touch, the job would have timed out after another second.
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 1500*time.Millisecond)
+	defer timeoutCancel()
+	if _, err := srv.Reserve(timeoutCtx, 2, srv.Watch(defaultTubes)); err != context.DeadlineExceeded {
+		t.Error("Expected the touched job to still be reserved. Got:", err)
+	}
+}
+
+func TestExpiredReservationDoesNotRequeueNewOne(t *T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newTestServer(ctx)
+	defer closeTestServer(srv)
+
+	job := addTestJob(t, srv, 0, time.Second)
+
+	if _, err := srv.Reserve(ctx, 1, srv.Watch(defaultTubes)); err != nil {
+		t.Fatal("Could not reserve job:", err)
+	}
+	// Released and reserved by another client without the TTRService being
+	// told, like in the moment after the first reservation timed out.
+	if err := srv.Storage.Release(1, job.ID, 0, 0); err != nil {
+		t.Fatal("Could not release job:", err)
+	}
+	if _, err := srv.Storage.ReserveByID(2, job.ID); err != nil {
+		t.Fatal("Could not reserve job:", err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	reserved, err := srv.Peek(job.ID)
+	if err != nil || reserved.State != geanstalkd.StateReserved || reserved.ReservedBy != 2 {
+		t.Error("Expected the job to still be reserved by the other client. Got:", reserved, err)
+	}
+}
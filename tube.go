@@ -0,0 +1,283 @@
+package geanstalkd
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrTubeMissing is returned when a tube doesn't exist.
+var ErrTubeMissing = errors.New("tube doesn't exist")
+
+// DefaultTube is the tube that clients use and watch when they connect. It
+// always exists.
+const DefaultTube Tube = "default"
+
+// UrgentPriority is the priority below which ready jobs are counted as
+// urgent.
+const UrgentPriority Priority = 1024
+
+// tubeQueues are the queues holding the jobs of a single tube, together with
+// the tube's counters.
+type tubeQueues struct {
+	ready  JobPriorityQueue
+	delay  JobPriorityQueue
+	buried JobQueue
+
+	// watchers are the watch sets containing this tube. They must be fixed
+	// every time the ready queue changes.
+	watchers map[*WatchSet]struct{}
+
+	// jobs is the number of jobs in each state.
+	jobs      map[JobState]int
+	urgent    int
+	totalJobs uint64
+	deletes   uint64
+	using     int
+
+	// pausedUntil is when the tube is resumed. Zero if the tube isn't paused.
+	// Paused tubes are not in the TubePriorityQueues of their watch sets.
+	pausedUntil time.Time
+	pause       time.Duration
+	pauses      uint64
+}
+
+func (q *tubeQueues) paused() bool {
+	return !q.pausedUntil.IsZero()
+}
+
+// count adds delta to the counters for a job in its current state.
+func (q *tubeQueues) count(j *Job, delta int) {
+	q.jobs[j.State] += delta
+	if j.State == StateReady && j.Priority < UrgentPriority {
+		q.urgent += delta
+	}
+}
+
+// TubeStats are the statistics of a tube as reported by the stats-tube
+// command.
+type TubeStats struct {
+	Name Tube
+
+	UrgentJobs   uint64
+	ReadyJobs    uint64
+	ReservedJobs uint64
+	DelayedJobs  uint64
+	BuriedJobs   uint64
+	// TotalJobs is the number of jobs ever put in the tube.
+	TotalJobs uint64
+
+	// Using is the number of clients using the tube.
+	Using uint64
+	// Watching is the number of clients watching the tube.
+	Watching uint64
+	// Waiting is the number of clients waiting to reserve a job from the
+	// tube.
+	Waiting uint64
+
+	Deletes uint64
+
+	// Pauses is the number of times the tube has been paused.
+	Pauses uint64
+	// Pause is the duration of the latest pause.
+	Pause time.Duration
+	// PauseTimeLeft is the time until the tube is resumed. Zero if the tube
+	// isn't paused.
+	PauseTimeLeft time.Duration
+}
+
+// StorageStats are the server-wide statistics of a StorageService.
+type StorageStats struct {
+	UrgentJobs   uint64
+	ReadyJobs    uint64
+	ReservedJobs uint64
+	DelayedJobs  uint64
+	BuriedJobs   uint64
+
+	Tubes uint64
+	// Waiting is the number of clients waiting to reserve a job.
+	Waiting uint64
+}
+
+// queues returns the queues for a tube, creating them if they don't exist.
+func (s *StorageService) queues(tube Tube) *tubeQueues {
+	if s.tubes == nil {
+		s.tubes = make(map[Tube]*tubeQueues)
+	}
+	q, ok := s.tubes[tube]
+	if !ok {
+		q = &tubeQueues{
+			ready:    s.NewJobPriorityQueue(),
+			delay:    s.NewJobPriorityQueue(),
+			buried:   s.NewJobQueue(),
+			watchers: make(map[*WatchSet]struct{}),
+			jobs:     make(map[JobState]int),
+		}
+		s.tubes[tube] = q
+		s.DelayTubes.Push(tube, q.delay)
+	}
+	return q
+}
+
+// removeIfUnused removes a tube which no client uses or watches and which
+// holds no jobs. The default tube is never removed.
+func (s *StorageService) removeIfUnused(tube Tube) {
+	q, ok := s.tubes[tube]
+	if !ok || tube == DefaultTube || q.using > 0 || len(q.watchers) > 0 {
+		return
+	}
+	for _, n := range q.jobs {
+		if n > 0 {
+			return
+		}
+	}
+
+	delete(s.tubes, tube)
+	delete(s.paused, tube)
+	s.DelayTubes.RemoveByTube(tube)
+}
+
+// Use registers that a client puts jobs in a tube, which keeps the tube from
+// being removed. Every call to Use must be followed by a call to Unuse.
+func (s *StorageService) Use(tube Tube) {
+	s.queues(tube).using++
+}
+
+// Unuse registers that a client no longer puts jobs in a tube.
+func (s *StorageService) Unuse(tube Tube) {
+	s.queues(tube).using--
+	s.removeIfUnused(tube)
+}
+
+// Tubes returns the names of all existing tubes, sorted by name.
+func (s *StorageService) Tubes() []Tube {
+	tubes := make([]Tube, 0, len(s.tubes)+1)
+	if _, ok := s.tubes[DefaultTube]; !ok {
+		tubes = append(tubes, DefaultTube)
+	}
+	for tube := range s.tubes {
+		tubes = append(tubes, tube)
+	}
+	sort.Slice(tubes, func(i, j int) bool { return tubes[i] < tubes[j] })
+	return tubes
+}
+
+// TubeStats returns the statistics of a tube. Returns ErrTubeMissing if the
+// tube doesn't exist.
+func (s *StorageService) TubeStats(tube Tube) (TubeStats, error) {
+	q, ok := s.tubes[tube]
+	if !ok {
+		if tube == DefaultTube {
+			return TubeStats{Name: tube}, nil
+		}
+		return TubeStats{}, ErrTubeMissing
+	}
+
+	stats := TubeStats{
+		Name:         tube,
+		UrgentJobs:   uint64(q.urgent),
+		ReadyJobs:    uint64(q.jobs[StateReady]),
+		ReservedJobs: uint64(q.jobs[StateReserved]),
+		DelayedJobs:  uint64(q.jobs[StateDelayed]),
+		BuriedJobs:   uint64(q.jobs[StateBuried]),
+		TotalJobs:    q.totalJobs,
+		Using:        uint64(q.using),
+		Deletes:      q.deletes,
+		Pauses:       q.pauses,
+		Pause:        q.pause,
+	}
+	if q.paused() {
+		if left := time.Until(q.pausedUntil); left > 0 {
+			stats.PauseTimeLeft = left
+		}
+	}
+	for ws := range q.watchers {
+		stats.Watching += uint64(ws.refs)
+		stats.Waiting += uint64(ws.waiting)
+	}
+	return stats, nil
+}
+
+// Stats returns the server-wide statistics of all tubes.
+func (s *StorageService) Stats() StorageStats {
+	stats := StorageStats{Tubes: uint64(len(s.tubes))}
+	if _, ok := s.tubes[DefaultTube]; !ok {
+		stats.Tubes++
+	}
+	for _, q := range s.tubes {
+		stats.UrgentJobs += uint64(q.urgent)
+		stats.ReadyJobs += uint64(q.jobs[StateReady])
+		stats.ReservedJobs += uint64(q.jobs[StateReserved])
+		stats.DelayedJobs += uint64(q.jobs[StateDelayed])
+		stats.BuriedJobs += uint64(q.jobs[StateBuried])
+	}
+	for _, ws := range s.watchSets {
+		stats.Waiting += uint64(ws.waiting)
+	}
+	return stats
+}
+
+// PauseTube keeps jobs in a tube from being reserved for a duration. Pausing a
+// paused tube replaces its pause. Returns ErrTubeMissing if the tube doesn't
+// exist.
+func (s *StorageService) PauseTube(tube Tube, pause time.Duration) error {
+	q, ok := s.tubes[tube]
+	if !ok {
+		if tube != DefaultTube {
+			return ErrTubeMissing
+		}
+		q = s.queues(tube)
+	}
+
+	if !q.paused() {
+		for ws := range q.watchers {
+			if err := ws.ready.RemoveByTube(tube); err != nil {
+				return err
+			}
+		}
+	}
+	q.pausedUntil = time.Now().Add(pause)
+	q.pause = pause
+	q.pauses++
+
+	if s.paused == nil {
+		s.paused = make(map[Tube]*tubeQueues)
+	}
+	s.paused[tube] = q
+	return nil
+}
+
+// ResumePaused resumes all tubes whose pause has ended at now. Returns the
+// number of tubes resumed.
+func (s *StorageService) ResumePaused(now time.Time) (int, error) {
+	resumed := 0
+	for tube, q := range s.paused {
+		if q.pausedUntil.After(now) {
+			continue
+		}
+
+		q.pausedUntil = time.Time{}
+		delete(s.paused, tube)
+		for ws := range q.watchers {
+			if err := ws.ready.Push(tube, q.ready); err != nil {
+				return resumed, err
+			}
+		}
+		resumed++
+	}
+	return resumed, nil
+}
+
+// NextResume returns when the next paused tube is resumed. Returns false if
+// no tube is paused.
+func (s *StorageService) NextResume() (time.Time, bool) {
+	var next time.Time
+	found := false
+	for _, q := range s.paused {
+		if !found || q.pausedUntil.Before(next) {
+			next = q.pausedUntil
+			found = true
+		}
+	}
+	return next, found
+}
@@ -5,9 +5,15 @@ import "context"
 // GenerateIds returns a channel with strictly monotonically increasing job
 // IDs. Generation stops are soon ctx is done.
 func GenerateIds(ctx context.Context) <-chan JobID {
+	return GenerateIdsFrom(ctx, 1)
+}
+
+// GenerateIdsFrom is like GenerateIds, but the first ID is first. It is used
+// to continue after the IDs of restored jobs.
+func GenerateIdsFrom(ctx context.Context, first JobID) <-chan JobID {
 	ids := make(chan JobID, 100)
 	go func() {
-		nextID := JobID(1)
+		nextID := first
 		for {
 			select {
 			case ids <- nextID: